@@ -15,18 +15,18 @@
 package surfer
 
 import (
-	"bytes"
 	"encoding/json"
 	"encoding/xml"
+	"fmt"
 	"io"
-	"io/ioutil"
-	"log"
 	"mime/multipart"
 	"net/url"
-	"strings"
+	"sort"
 )
 
 // body set request body
+// SetBody sets the Content-Type header and installs a factory on the Request
+// that yields a fresh reader of the whole payload for every attempt and redirect.
 type body interface {
 	SetBody(*Request) error
 }
@@ -42,7 +42,7 @@ var _ body = new(Content)
 // SetBody sets request body
 func (c *Content) SetBody(r *Request) error {
 	r.Header.Set("Content-Type", c.ContentType)
-	r.body = bytes.NewReader(c.Bytes)
+	r.setBytesBody(c.Bytes)
 	return nil
 }
 
@@ -53,7 +53,7 @@ var _ body = Bytes("")
 
 // SetBody sets request body
 func (b Bytes) SetBody(r *Request) error {
-	r.body = bytes.NewReader(b)
+	r.setBytesBody(b)
 	return nil
 }
 
@@ -75,40 +75,59 @@ type (
 var _ body = new(Form)
 
 // SetBody sets request body
+// Multipart bodies are streamed through a pipe that is regenerated for every attempt;
+// the boundary and field order are fixed so the Content-Length is known in advance.
 func (f Form) SetBody(r *Request) error {
-	if len(f.Files) > 0 {
+	if len(f.Files) == 0 {
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		r.setBytesBody([]byte(url.Values(f.Values).Encode()))
+		return nil
+	}
+
+	boundary := multipart.NewWriter(nil).Boundary()
+	var counter countWriter
+	if err := f.writeMultipart(&counter, boundary); err != nil {
+		return err
+	}
+	r.Header.Set("Content-Type", "multipart/form-data; boundary="+boundary)
+	r.contentLength = int64(counter)
+	r.getBody = func() (io.ReadCloser, error) {
 		pr, pw := io.Pipe()
-		bodyWriter := multipart.NewWriter(pw)
 		go func() {
-			for fieldname, postfiles := range f.Files {
-				for _, postfile := range postfiles {
-					fileWriter, err := bodyWriter.CreateFormFile(fieldname, postfile.Filename)
-					if err != nil {
-						log.Println("[E] Surfer: Multipart:", err)
-					}
-					_, err = fileWriter.Write(postfile.Bytes)
-					if err != nil {
-						log.Println("[E] Surfer: Multipart:", err)
-					}
-				}
-			}
-			for k, v := range f.Values {
-				for _, vv := range v {
-					bodyWriter.WriteField(k, vv)
-				}
-			}
-			bodyWriter.Close()
-			pw.Close()
+			pw.CloseWithError(f.writeMultipart(pw, boundary))
 		}()
-		r.Header.Set("Content-Type", bodyWriter.FormDataContentType())
-		r.body = ioutil.NopCloser(pr)
-	} else {
-		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
-		r.body = strings.NewReader(url.Values(f.Values).Encode())
+		return pr, nil
 	}
 	return nil
 }
 
+// writeMultipart writes the multipart form to w, in a stable field order.
+func (f Form) writeMultipart(w io.Writer, boundary string) error {
+	bodyWriter := multipart.NewWriter(w)
+	if err := bodyWriter.SetBoundary(boundary); err != nil {
+		return err
+	}
+	for _, fieldname := range sortedKeys(f.Files) {
+		for _, postfile := range f.Files[fieldname] {
+			fileWriter, err := bodyWriter.CreateFormFile(fieldname, postfile.Filename)
+			if err != nil {
+				return fmt.Errorf("multipart: %v", err)
+			}
+			if _, err = fileWriter.Write(postfile.Bytes); err != nil {
+				return fmt.Errorf("multipart: %v", err)
+			}
+		}
+	}
+	for _, k := range sortedKeys(f.Values) {
+		for _, vv := range f.Values[k] {
+			if err := bodyWriter.WriteField(k, vv); err != nil {
+				return fmt.Errorf("multipart: %v", err)
+			}
+		}
+	}
+	return bodyWriter.Close()
+}
+
 // JSONObj JSON type of body content
 type JSONObj struct{ Data interface{} }
 
@@ -124,7 +143,7 @@ func (obj *JSONObj) SetBody(r *Request) error {
 	if err != nil {
 		return err
 	}
-	r.body = bytes.NewReader(b)
+	r.setBytesBody(b)
 	return nil
 }
 
@@ -143,6 +162,31 @@ func (obj *XMLObj) SetBody(r *Request) error {
 	if err != nil {
 		return err
 	}
-	r.body = bytes.NewReader(b)
+	r.setBytesBody(b)
 	return nil
 }
+
+// countWriter counts the bytes written to it.
+type countWriter int64
+
+func (c *countWriter) Write(p []byte) (int, error) {
+	*c += countWriter(len(p))
+	return len(p), nil
+}
+
+// sortedKeys returns the keys of a form map in order.
+func sortedKeys(m interface{}) []string {
+	var keys []string
+	switch m := m.(type) {
+	case map[string][]string:
+		for k := range m {
+			keys = append(keys, k)
+		}
+	case map[string][]File:
+		for k := range m {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
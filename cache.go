@@ -0,0 +1,491 @@
+// Copyright 2015 henrylee2cn Author. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package surfer
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// constant
+const (
+	DefaultMaxCacheEntry = 32 << 20 // Cache.MaxEntrySize为0时，可缓存响应体的最大字节数
+)
+
+// XFromCache is the header set on responses served from the Cache.
+const XFromCache = "X-From-Cache"
+
+// FromCache reports whether resp was served from the Cache, fresh or revalidated.
+func FromCache(resp *http.Response) bool {
+	return resp != nil && resp.Header.Get(XFromCache) != ""
+}
+
+// CacheStorage stores serialized cache entries by key.
+type CacheStorage interface {
+	// Get returns the entry stored under key, ok is false when there is none
+	Get(key string) (value []byte, ok bool)
+	// Set stores value under key
+	Set(key string, value []byte) error
+	// Delete removes the entry stored under key
+	Delete(key string) error
+}
+
+// DiskStorage is a CacheStorage keeping every entry in its own file under Dir.
+type DiskStorage struct {
+	Dir string
+}
+
+var _ CacheStorage = DiskStorage{}
+
+func (d DiskStorage) path(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	name := hex.EncodeToString(sum[:])
+	return filepath.Join(d.Dir, name[:2], name)
+}
+
+// Get implements CacheStorage.
+func (d DiskStorage) Get(key string) ([]byte, bool) {
+	b, err := ioutil.ReadFile(d.path(key))
+	return b, err == nil
+}
+
+// Set implements CacheStorage, writing through a temporary file so readers never see partial entries.
+func (d DiskStorage) Set(key string, value []byte) error {
+	p := d.path(key)
+	if err := os.MkdirAll(filepath.Dir(p), 0777); err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(filepath.Dir(p), ".tmp-")
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(value); err == nil {
+		err = f.Close()
+	} else {
+		f.Close()
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), p)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
+
+// Delete implements CacheStorage.
+func (d DiskStorage) Delete(key string) error {
+	err := os.Remove(d.path(key))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// Cache is an RFC 7234 private HTTP cache for the Surf engine.
+// GET responses are stored keyed by URL and the request headers named in Vary;
+// fresh entries are served without touching the network and stale ones are
+// revalidated with If-None-Match/If-Modified-Since. Requests answered from the
+// cache skip the robots.txt check and the Limiter; robots.txt is cached as well.
+type Cache struct {
+	// Storage holds the entries
+	Storage CacheStorage
+	// ForceCache serves every stored entry regardless of its freshness and stores
+	// every GET response regardless of its cache headers, e.g. to iterate on parsers offline
+	ForceCache bool
+	// MaxEntrySize is the longest body stored, 0 means DefaultMaxCacheEntry;
+	// longer responses, or longer than the request's MaxBodySize, are passed on without being stored
+	MaxEntrySize int64
+}
+
+// NewDiskCache returns a Cache storing its entries under dir.
+func NewDiskCache(dir string) *Cache {
+	return &Cache{Storage: DiskStorage{Dir: dir}}
+}
+
+// cacheEntry is the stored form of a response.
+type cacheEntry struct {
+	StatusCode   int
+	Proto        string
+	Header       http.Header
+	Body         []byte
+	RequestTime  time.Time
+	ResponseTime time.Time
+}
+
+// cacheTransport serves requests from the Cache before falling back to the transport.
+type cacheTransport struct {
+	cache     *Cache
+	transport http.RoundTripper
+	// maxBody is the MaxBodySize of the request, 0 means none
+	maxBody int64
+}
+
+// RoundTrip implements http.RoundTripper.
+func (t *cacheTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	c := t.cache
+	if req.Method != "GET" && req.Method != "HEAD" {
+		resp, err := t.transport.RoundTrip(req)
+		if err == nil && resp.StatusCode < 400 && req.Method != "OPTIONS" && req.Method != "TRACE" {
+			c.invalidate(req)
+		}
+		return resp, err
+	}
+	reqCC := parseCacheControl(req.Header)
+	if _, ok := reqCC["no-store"]; ok {
+		return t.transport.RoundTrip(req)
+	}
+
+	entry := c.load(req)
+	if entry != nil {
+		if c.servable(entry, reqCC) {
+			return entry.response(req), nil
+		}
+		if etag := entry.Header.Get("ETag"); etag != "" || entry.Header.Get("Last-Modified") != "" {
+			condReq := req.Clone(req.Context())
+			if etag != "" {
+				condReq.Header.Set("If-None-Match", etag)
+			}
+			if lm := entry.Header.Get("Last-Modified"); lm != "" {
+				condReq.Header.Set("If-Modified-Since", lm)
+			}
+			req = condReq
+		}
+	}
+
+	requestTime := time.Now()
+	resp, err := t.transport.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	if entry != nil && resp.StatusCode == http.StatusNotModified {
+		resp.Body.Close()
+		for k, v := range resp.Header {
+			if k != "Content-Length" {
+				entry.Header[k] = v
+			}
+		}
+		entry.RequestTime, entry.ResponseTime = requestTime, time.Now()
+		c.store(req, entry)
+		return entry.response(req), nil
+	}
+	limit := c.MaxEntrySize
+	if limit <= 0 {
+		limit = DefaultMaxCacheEntry
+	}
+	if t.maxBody > 0 && t.maxBody < limit {
+		limit = t.maxBody
+	}
+	if req.Method != "GET" || !c.storable(resp) || resp.ContentLength > limit {
+		return resp, nil
+	}
+	resp.Body = &cachingBody{
+		ReadCloser: resp.Body,
+		limit:      limit,
+		done: func(body []byte) {
+			c.store(req, &cacheEntry{
+				StatusCode:   resp.StatusCode,
+				Proto:        resp.Proto,
+				Header:       resp.Header.Clone(),
+				Body:         body,
+				RequestTime:  requestTime,
+				ResponseTime: time.Now(),
+			})
+		},
+	}
+	return resp, nil
+}
+
+// hit reports whether req is answered from the cache without touching the network,
+// so that robots.txt and the Limiter can be skipped for it.
+func (c *Cache) hit(req *http.Request) bool {
+	if req.Method != "GET" && req.Method != "HEAD" {
+		return false
+	}
+	reqCC := parseCacheControl(req.Header)
+	if _, ok := reqCC["no-store"]; ok {
+		return false
+	}
+	entry := c.load(req)
+	return entry != nil && c.servable(entry, reqCC)
+}
+
+// servable reports whether entry may be served without revalidation.
+func (c *Cache) servable(entry *cacheEntry, reqCC map[string]string) bool {
+	return c.ForceCache || entry.fresh(reqCC) && entry.cacheable()
+}
+
+// storable reports whether resp may be stored.
+func (c *Cache) storable(resp *http.Response) bool {
+	cc := parseCacheControl(resp.Header)
+	if _, ok := cc["no-store"]; ok {
+		return false
+	}
+	if strings.TrimSpace(resp.Header.Get("Vary")) == "*" {
+		return false
+	}
+	if c.ForceCache {
+		return true
+	}
+	switch resp.StatusCode {
+	case 200, 203, 204, 300, 301, 404, 405, 410, 414, 501:
+		return true
+	}
+	if _, ok := cc["max-age"]; ok {
+		return true
+	}
+	return resp.Header.Get("Expires") != ""
+}
+
+// primaryKey is the part of the cache key that does not depend on Vary.
+func primaryKey(req *http.Request) string {
+	return "GET " + req.URL.String()
+}
+
+// variantKey extends primaryKey with the request values of the headers named in vary.
+func variantKey(req *http.Request, vary []string) string {
+	key := primaryKey(req)
+	for _, name := range vary {
+		key += "\n" + name + ":" + strings.Join(req.Header[name], ",")
+	}
+	return key
+}
+
+// varyNames returns the canonical, sorted header names listed in the Vary header.
+func varyNames(h http.Header) []string {
+	var names []string
+	for _, v := range h["Vary"] {
+		for _, name := range strings.Split(v, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				names = append(names, http.CanonicalHeaderKey(name))
+			}
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// load returns the stored entry matching req, or nil.
+func (c *Cache) load(req *http.Request) *cacheEntry {
+	var vary []string
+	if b, ok := c.Storage.Get("vary " + primaryKey(req)); ok {
+		json.Unmarshal(b, &vary)
+	}
+	b, ok := c.Storage.Get(variantKey(req, vary))
+	if !ok {
+		return nil
+	}
+	entry := new(cacheEntry)
+	if json.Unmarshal(b, entry) != nil {
+		return nil
+	}
+	return entry
+}
+
+// store saves entry for req under its Vary-dependent key.
+func (c *Cache) store(req *http.Request, entry *cacheEntry) {
+	vary := varyNames(entry.Header)
+	if len(vary) > 0 {
+		b, _ := json.Marshal(vary)
+		c.Storage.Set("vary "+primaryKey(req), b)
+	} else {
+		c.Storage.Delete("vary " + primaryKey(req))
+	}
+	if b, err := json.Marshal(entry); err == nil {
+		c.Storage.Set(variantKey(req, vary), b)
+	}
+}
+
+// invalidate drops the entry of req's URL after an unsafe method succeeded.
+func (c *Cache) invalidate(req *http.Request) {
+	var vary []string
+	if b, ok := c.Storage.Get("vary " + primaryKey(req)); ok {
+		json.Unmarshal(b, &vary)
+	}
+	c.Storage.Delete(variantKey(req, vary))
+}
+
+// cacheable reports whether the entry may be served without revalidation at all.
+func (e *cacheEntry) cacheable() bool {
+	cc := parseCacheControl(e.Header)
+	_, noCache := cc["no-cache"]
+	return !noCache && e.Header.Get("Pragma") != "no-cache"
+}
+
+// fresh reports whether the entry is still fresh, taking the request's
+// max-age, min-fresh and max-stale directives into account.
+func (e *cacheEntry) fresh(reqCC map[string]string) bool {
+	if _, ok := reqCC["no-cache"]; ok {
+		return false
+	}
+	lifetime := e.freshnessLifetime()
+	age := e.currentAge()
+	if v, ok := reqCC["max-age"]; ok {
+		if d, err := strconv.Atoi(v); err == nil && age > time.Duration(d)*time.Second {
+			return false
+		}
+	}
+	if v, ok := reqCC["min-fresh"]; ok {
+		if d, err := strconv.Atoi(v); err == nil {
+			age += time.Duration(d) * time.Second
+		}
+	}
+	if v, ok := reqCC["max-stale"]; ok {
+		if _, mustRevalidate := parseCacheControl(e.Header)["must-revalidate"]; !mustRevalidate {
+			if v == "" {
+				return true
+			}
+			if d, err := strconv.Atoi(v); err == nil {
+				lifetime += time.Duration(d) * time.Second
+			}
+		}
+	}
+	return age < lifetime
+}
+
+// freshnessLifetime computes the lifetime from max-age, Expires or,
+// heuristically, a tenth of the time since Last-Modified.
+func (e *cacheEntry) freshnessLifetime() time.Duration {
+	cc := parseCacheControl(e.Header)
+	if v, ok := cc["max-age"]; ok {
+		if d, err := strconv.Atoi(v); err == nil {
+			return time.Duration(d) * time.Second
+		}
+		return 0
+	}
+	date := e.date()
+	if v := e.Header.Get("Expires"); v != "" {
+		expires, err := http.ParseTime(v)
+		if err != nil {
+			return 0
+		}
+		return expires.Sub(date)
+	}
+	if v := e.Header.Get("Last-Modified"); v != "" {
+		if lm, err := http.ParseTime(v); err == nil && date.After(lm) {
+			return date.Sub(lm) / 10
+		}
+	}
+	return 0
+}
+
+// currentAge computes the age of the entry as in RFC 7234 section 4.2.3.
+func (e *cacheEntry) currentAge() time.Duration {
+	apparentAge := e.ResponseTime.Sub(e.date())
+	if apparentAge < 0 {
+		apparentAge = 0
+	}
+	responseDelay := e.ResponseTime.Sub(e.RequestTime)
+	correctedAge := responseDelay
+	if age, err := strconv.Atoi(e.Header.Get("Age")); err == nil {
+		correctedAge += time.Duration(age) * time.Second
+	}
+	if apparentAge > correctedAge {
+		correctedAge = apparentAge
+	}
+	return correctedAge + time.Since(e.ResponseTime)
+}
+
+func (e *cacheEntry) date() time.Time {
+	if date, err := http.ParseTime(e.Header.Get("Date")); err == nil {
+		return date
+	}
+	return e.ResponseTime
+}
+
+// response rebuilds the *http.Response of the entry for req.
+func (e *cacheEntry) response(req *http.Request) *http.Response {
+	header := e.Header.Clone()
+	header.Set(XFromCache, "1")
+	header.Set("Age", strconv.Itoa(int(e.currentAge().Seconds())))
+	proto := e.Proto
+	major, minor, ok := http.ParseHTTPVersion(proto)
+	if !ok {
+		proto, major, minor = "HTTP/1.1", 1, 1
+	}
+	resp := &http.Response{
+		Status:        strconv.Itoa(e.StatusCode) + " " + http.StatusText(e.StatusCode),
+		StatusCode:    e.StatusCode,
+		Proto:         proto,
+		ProtoMajor:    major,
+		ProtoMinor:    minor,
+		Header:        header,
+		ContentLength: int64(len(e.Body)),
+		Request:       req,
+	}
+	if req.Method == "HEAD" {
+		resp.Body = http.NoBody
+	} else {
+		resp.Body = ioutil.NopCloser(bytes.NewReader(e.Body))
+	}
+	return resp
+}
+
+// parseCacheControl parses the Cache-Control directives of h into lower-cased names and values.
+func parseCacheControl(h http.Header) map[string]string {
+	cc := make(map[string]string)
+	for _, v := range h["Cache-Control"] {
+		for _, directive := range strings.Split(v, ",") {
+			directive = strings.TrimSpace(directive)
+			if directive == "" {
+				continue
+			}
+			name, value := directive, ""
+			if i := strings.IndexByte(directive, '='); i >= 0 {
+				name, value = directive[:i], strings.Trim(directive[i+1:], `" `)
+			}
+			cc[strings.ToLower(strings.TrimSpace(name))] = value
+		}
+	}
+	return cc
+}
+
+// cachingBody buffers the body as it is read and hands it to done once it is complete.
+// A body longer than limit is not buffered any further, nor stored.
+type cachingBody struct {
+	io.ReadCloser
+	buf   bytes.Buffer
+	limit int64
+	done  func([]byte)
+}
+
+func (b *cachingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if b.done == nil {
+		return n, err
+	}
+	if int64(b.buf.Len()+n) > b.limit {
+		b.done = nil
+		b.buf = bytes.Buffer{}
+		return n, err
+	}
+	b.buf.Write(p[:n])
+	if err == io.EOF {
+		b.done(b.buf.Bytes())
+		b.done = nil
+	}
+	return n, err
+}
@@ -0,0 +1,175 @@
+// Copyright 2015 henrylee2cn Author. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package surfer
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCache(t *testing.T) {
+	var hits, notModified int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		switch r.URL.Path {
+		case "/fresh":
+			w.Header().Set("Cache-Control", "max-age=60")
+		case "/stale":
+			w.Header().Set("Cache-Control", "no-cache")
+			w.Header().Set("ETag", `"v1"`)
+			if r.Header.Get("If-None-Match") == `"v1"` {
+				atomic.AddInt32(&notModified, 1)
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+		case "/vary":
+			w.Header().Set("Cache-Control", "max-age=60")
+			w.Header().Set("Vary", "Accept-Language")
+			w.Write([]byte(r.Header.Get("Accept-Language")))
+			return
+		}
+		w.Write([]byte(r.URL.Path))
+	}))
+	defer srv.Close()
+
+	s := New().(*Surf)
+	s.Cache = NewDiskCache(t.TempDir())
+	get := func(path string, header http.Header) (string, bool) {
+		resp, err := s.Download(&Request{Url: srv.URL + path, Header: header})
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := BodyBytes(resp)
+		return string(b), FromCache(resp)
+	}
+
+	for _, path := range []string{"/fresh", "/stale"} {
+		if body, cached := get(path, nil); cached || body != path {
+			t.Fatalf("%s: first download: %q cached=%v", path, body, cached)
+		}
+		if body, cached := get(path, nil); !cached || body != path {
+			t.Fatalf("%s: second download: %q cached=%v", path, body, cached)
+		}
+	}
+	if hits != 3 || notModified != 1 {
+		t.Fatalf("expected 3 hits with 1 revalidation, got %d and %d", hits, notModified)
+	}
+
+	en := http.Header{"Accept-Language": {"en"}}
+	zh := http.Header{"Accept-Language": {"zh"}}
+	get("/vary", en)
+	if body, cached := get("/vary", zh); cached || body != "zh" {
+		t.Fatalf("vary: served %q cached=%v for another language", body, cached)
+	}
+	if body, cached := get("/vary", zh); !cached || body != "zh" {
+		t.Fatalf("vary: expected cached zh, got %q cached=%v", body, cached)
+	}
+
+	s.Cache.ForceCache = true
+	srv.Close()
+	if body, cached := get("/stale", nil); !cached || body != "/stale" {
+		t.Fatalf("force cache: %q cached=%v", body, cached)
+	}
+}
+
+func TestCacheOffline(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/robots.txt" {
+			w.Write([]byte("User-agent: *\nDisallow: /private\n"))
+			return
+		}
+		w.Write([]byte(r.URL.Path))
+	}))
+
+	s := New().(*Surf)
+	s.Cache = NewDiskCache(t.TempDir())
+	s.Cache.ForceCache = true
+	s.Robots = new(Robots)
+	s.Limiter = &Limiter{MinDelay: 300 * time.Millisecond}
+	get := func(path string) (string, error) {
+		resp, err := s.Download(&Request{Url: srv.URL + path})
+		if err != nil {
+			return "", err
+		}
+		b, _ := BodyBytes(resp)
+		return string(b), nil
+	}
+	for _, path := range []string{"/a", "/b"} {
+		if _, err := get(path); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// parsers are iterated on offline, with robots.txt and the pages from the cache
+	srv.Close()
+	s.Robots = new(Robots)
+	start := time.Now()
+	for _, path := range []string{"/a", "/b", "/a"} {
+		if body, err := get(path); err != nil || body != path {
+			t.Fatalf("%s: got %q, %v", path, body, err)
+		}
+	}
+	if d := time.Since(start); d >= 300*time.Millisecond {
+		t.Errorf("cache hits waited for the limiter: %v", d)
+	}
+	if _, err := get("/private"); !errors.Is(err, ErrRobotsDisallowed) {
+		t.Errorf("expected the cached robots.txt to disallow /private, got %v", err)
+	}
+}
+
+func TestCacheEntrySize(t *testing.T) {
+	var hits int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		w.Header().Set("Cache-Control", "max-age=60")
+		// chunked, the length is only known at the end
+		for i := 0; i < 4; i++ {
+			w.Write(bytes.Repeat([]byte{'x'}, 512))
+			w.(http.Flusher).Flush()
+		}
+	}))
+	defer srv.Close()
+
+	s := New().(*Surf)
+	s.Cache = NewDiskCache(t.TempDir())
+	// the limit is the smaller one of MaxEntrySize and the request's MaxBodySize
+	get := func(path string, maxBody int64) {
+		resp, err := s.Download(&Request{Url: srv.URL + path, MaxBodySize: maxBody})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if b, err := BodyBytes(resp); err != nil || len(b) != 2048 || FromCache(resp) {
+			t.Errorf("%s: got %d bytes, %v, cached=%v", path, len(b), err, FromCache(resp))
+		}
+	}
+	// too long for the cache: streamed but not stored
+	s.Cache.MaxEntrySize = 1024
+	get("/a", 0)
+	get("/a", 0)
+	if n := atomic.LoadInt32(&hits); n != 2 {
+		t.Errorf("expected 2 downloads, got %d", n)
+	}
+	s.Cache.MaxEntrySize = 0
+	get("/b", 4096)
+	resp, err := s.Download(&Request{Url: srv.URL + "/b"})
+	if err != nil || !FromCache(resp) {
+		t.Errorf("a body within the limit was not cached: %v", err)
+	}
+}
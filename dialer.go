@@ -0,0 +1,278 @@
+// Copyright 2015 henrylee2cn Author. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package surfer
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http/httptrace"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// AddressFamily selects the IP versions the Surf engine connects over.
+type AddressFamily int
+
+// address families
+const (
+	// HappyEyeballs uses IPv4 and IPv6, starting the other family when the
+	// first one has not connected within 300ms (RFC 8305)
+	HappyEyeballs AddressFamily = iota
+	// IPv4Only connects over IPv4 only
+	IPv4Only
+	// IPv6Only connects over IPv6 only
+	IPv6Only
+)
+
+// constant
+const fallbackDelay = 300 * time.Millisecond // Happy Eyeballs 启动另一地址族前的等待时间
+
+// addressFamily returns the AddressFamily in effect, the request's own one overriding the engine's.
+func (r *Request) addressFamily(engine AddressFamily) AddressFamily {
+	if r.AddressFamily != HappyEyeballs {
+		return r.AddressFamily
+	}
+	return engine
+}
+
+// localAddrs returns the local addresses in effect, the request's own ones overriding the engine's.
+func (r *Request) localAddrs(engine []string) []string {
+	if len(r.LocalAddrs) > 0 {
+		return r.LocalAddrs
+	}
+	return engine
+}
+
+// parseLocalAddrs parses local IP addresses to bind.
+func parseLocalAddrs(addrs []string) ([]net.IP, error) {
+	ips := make([]net.IP, 0, len(addrs))
+	for _, a := range addrs {
+		ip := net.ParseIP(strings.TrimSpace(a))
+		if ip == nil {
+			return nil, fmt.Errorf("surfer: invalid local address %q", a)
+		}
+		ips = append(ips, ip)
+	}
+	return ips, nil
+}
+
+// hostDialer dials TCP connections, resolving host names through
+// static overrides first and then a Resolver.
+type hostDialer struct {
+	timeout time.Duration
+	// resolver nil uses the system resolver without caching
+	resolver *Resolver
+	// hosts maps lower-case "host:port" or "host" to an IP address
+	hosts  map[string]string
+	family AddressFamily
+	// local addresses to bind, rotated over the connections
+	local []net.IP
+	next  uint32
+}
+
+// lookup returns the addresses to connect to for host:port. With remote,
+// host names without a static override are returned as they are, to be
+// resolved by a proxy.
+func (d *hostDialer) lookup(ctx context.Context, host, port string, remote bool) ([]string, error) {
+	name := strings.ToLower(strings.TrimSuffix(host, "."))
+	var addrs []string
+	if net.ParseIP(host) != nil {
+		addrs = []string{host}
+	} else if ip, ok := d.hosts[net.JoinHostPort(name, port)]; ok {
+		addrs = []string{ip}
+	} else if ip, ok := d.hosts[name]; ok {
+		addrs = []string{ip}
+	} else if remote {
+		return []string{host}, nil
+	} else {
+		trace := httptrace.ContextClientTrace(ctx)
+		if trace != nil && trace.DNSStart != nil {
+			trace.DNSStart(httptrace.DNSStartInfo{Host: name})
+		}
+		var err error
+		if d.resolver != nil {
+			addrs, err = d.resolver.LookupHost(ctx, name)
+		} else {
+			addrs, err = net.DefaultResolver.LookupHost(ctx, name)
+		}
+		if trace != nil && trace.DNSDone != nil {
+			done := httptrace.DNSDoneInfo{Err: err}
+			for _, a := range addrs {
+				done.Addrs = append(done.Addrs, net.IPAddr{IP: net.ParseIP(a)})
+			}
+			trace.DNSDone(done)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	usable := addrs[:0:0]
+	for _, a := range addrs {
+		if d.usable(net.ParseIP(a)) {
+			usable = append(usable, a)
+		}
+	}
+	if len(usable) == 0 {
+		return nil, &net.DNSError{Err: "no address of a usable IP version", Name: host}
+	}
+	return usable, nil
+}
+
+// usable reports whether ip fits the address family and the local addresses.
+func (d *hostDialer) usable(ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	v4 := ip.To4() != nil
+	switch {
+	case d.family == IPv4Only && !v4, d.family == IPv6Only && v4:
+		return false
+	case len(d.local) > 0:
+		return d.localFor(ip, false) != nil
+	}
+	return true
+}
+
+// localFor returns the local address of ip's IP version to bind, rotating
+// over the configured ones when next is true; nil means any.
+func (d *hostDialer) localFor(ip net.IP, next bool) net.IP {
+	v4 := ip.To4() != nil
+	var candidates []net.IP
+	for _, l := range d.local {
+		if (l.To4() != nil) == v4 {
+			candidates = append(candidates, l)
+		}
+	}
+	if len(candidates) == 0 {
+		return nil
+	}
+	if !next {
+		return candidates[0]
+	}
+	n := atomic.AddUint32(&d.next, 1) - 1
+	return candidates[n%uint32(len(candidates))]
+}
+
+// DialContext connects to addr. The addresses of the first IP version are
+// tried in turn; with HappyEyeballs the other version is raced against them.
+func (d *hostDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	if d.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, d.timeout)
+		defer cancel()
+	}
+	addrs, err := d.lookup(ctx, host, port, false)
+	if err != nil {
+		return nil, &net.OpError{Op: "dial", Net: network, Err: err}
+	}
+	var primaries, fallbacks []string
+	v4 := net.ParseIP(addrs[0]).To4() != nil
+	for _, a := range addrs {
+		if (net.ParseIP(a).To4() != nil) == v4 {
+			primaries = append(primaries, a)
+		} else {
+			fallbacks = append(fallbacks, a)
+		}
+	}
+	if len(fallbacks) == 0 {
+		return d.dialSerial(ctx, network, port, primaries)
+	}
+
+	type dialResult struct {
+		conn    net.Conn
+		err     error
+		primary bool
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	results := make(chan dialResult, 2)
+	start := func(addrs []string, primary bool) {
+		go func() {
+			conn, err := d.dialSerial(ctx, network, port, addrs)
+			results <- dialResult{conn, err, primary}
+		}()
+	}
+	start(primaries, true)
+	pending := 1
+	timer := time.NewTimer(fallbackDelay)
+	defer timer.Stop()
+	fallbackStarted := false
+	var primaryErr error
+	for {
+		select {
+		case <-timer.C:
+			if !fallbackStarted {
+				start(fallbacks, false)
+				fallbackStarted = true
+				pending++
+			}
+		case res := <-results:
+			pending--
+			if res.err == nil {
+				// close a connection that wins late
+				go func(pending int) {
+					for ; pending > 0; pending-- {
+						if res := <-results; res.conn != nil {
+							res.conn.Close()
+						}
+					}
+				}(pending)
+				return res.conn, nil
+			}
+			if res.primary {
+				primaryErr = res.err
+			}
+			if !fallbackStarted {
+				start(fallbacks, false)
+				fallbackStarted = true
+				pending++
+			}
+			if pending == 0 {
+				if primaryErr != nil {
+					return nil, primaryErr
+				}
+				return nil, res.err
+			}
+		}
+	}
+}
+
+// dialSerial connects to the first reachable address of addrs.
+func (d *hostDialer) dialSerial(ctx context.Context, network, port string, addrs []string) (net.Conn, error) {
+	var firstErr error
+	for _, a := range addrs {
+		var dialer net.Dialer
+		if local := d.localFor(net.ParseIP(a), true); local != nil {
+			dialer.LocalAddr = &net.TCPAddr{IP: local}
+		}
+		conn, err := dialer.DialContext(ctx, network, net.JoinHostPort(a, port))
+		if err == nil {
+			return conn, nil
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, firstErr
+}
@@ -0,0 +1,123 @@
+// Copyright 2015 henrylee2cn Author. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package surfer
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestLocalAddrs(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Connection", "close")
+		host, _, _ := net.SplitHostPort(r.RemoteAddr)
+		w.Write([]byte(host))
+	}))
+	defer srv.Close()
+
+	s := &Surf{LocalAddrs: []string{"127.0.0.2", "::1"}}
+	var seen []string
+	for i := 0; i < 3; i++ {
+		req := &Request{Url: srv.URL}
+		if i == 2 {
+			req.LocalAddrs = []string{"127.0.0.3"}
+		}
+		resp, err := s.Download(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := BodyBytes(resp)
+		local, _, _ := net.SplitHostPort(Info(resp).LocalAddr.String())
+		if local != string(b) {
+			t.Errorf("reported local address %s, server saw %s", local, b)
+		}
+		seen = append(seen, local)
+	}
+	if seen[0] != "127.0.0.2" || seen[1] != "127.0.0.2" || seen[2] != "127.0.0.3" {
+		t.Errorf("connected from %v", seen)
+	}
+
+	s = &Surf{LocalAddrs: []string{"127.0.0.2", "127.0.0.3"}}
+	seen = nil
+	for i := 0; i < 2; i++ {
+		resp, err := s.Download(&Request{Url: srv.URL})
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := BodyBytes(resp)
+		seen = append(seen, string(b))
+	}
+	if seen[0] == seen[1] {
+		t.Errorf("local addresses were not rotated: %v", seen)
+	}
+
+	if _, err := s.Download(&Request{Url: srv.URL, LocalAddrs: []string{"::1"}, TryTimes: 1}); err == nil {
+		t.Error("expected an error without a local address of the server's IP version")
+	}
+	if _, err := s.Download(&Request{Url: srv.URL, LocalAddrs: []string{"not-an-ip"}, TryTimes: 1}); err == nil {
+		t.Error("expected an error for an invalid local address")
+	}
+}
+
+func TestAddressFamily(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+
+	// an unreachable IPv6 address first, as a resolver preferring IPv6 returns them
+	r := new(Resolver)
+	done := make(chan struct{})
+	close(done)
+	r.cache = map[string]*dnsEntry{"dual.test": {
+		done:    done,
+		addrs:   []string{"100::1", "127.0.0.1"},
+		expires: time.Now().Add(time.Hour),
+	}}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for _, c := range []struct {
+		family AddressFamily
+		ok     bool
+	}{
+		{HappyEyeballs, true},
+		{IPv4Only, true},
+		{IPv6Only, false},
+	} {
+		d := &hostDialer{timeout: time.Second, resolver: r, family: c.family}
+		conn, err := d.DialContext(ctx, "tcp", "dual.test:"+port)
+		if (err == nil) != c.ok {
+			t.Errorf("family %d: got error %v", c.family, err)
+		}
+		if conn != nil {
+			conn.Close()
+		}
+	}
+}
@@ -0,0 +1,225 @@
+// Copyright 2015 henrylee2cn Author. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package surfer
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// constant
+const (
+	dohMediaType   = "application/dns-message" // RFC 8484 消息类型
+	maxDoHResponse = 64 << 10                  // DNS消息最大长度
+	dnsTypeA       = 1
+	dnsTypeAAAA    = 28
+	dnsRcodeNXName = 3
+)
+
+// NewDoHResolver returns a caching Resolver querying the DNS-over-HTTPS endpoint,
+// e.g. "https://1.1.1.1/dns-query".
+func NewDoHResolver(endpoint string) *Resolver {
+	return &Resolver{DoH: endpoint}
+}
+
+// dohClient is used by resolvers without their own Client.
+var dohClient = &http.Client{Timeout: 10 * time.Second}
+
+// lookupDoH resolves host with A and AAAA queries to r.DoH, returning the
+// addresses and the smallest TTL of the answers. It fails only when both
+// queries failed or found nothing.
+func (r *Resolver) lookupDoH(ctx context.Context, host string) ([]string, time.Duration, error) {
+	type result struct {
+		addrs []string
+		ttl   time.Duration
+		err   error
+	}
+	aaaa := make(chan result, 1)
+	go func() {
+		var res result
+		res.addrs, res.ttl, res.err = r.queryDoH(ctx, host, dnsTypeAAAA)
+		aaaa <- res
+	}()
+	addrs, ttl, err := r.queryDoH(ctx, host, dnsTypeA)
+	res := <-aaaa
+	// one family is enough, e.g. with IPv4-only servers or an AAAA query timing out
+	switch {
+	case err != nil && len(res.addrs) > 0:
+		return res.addrs, res.ttl, nil
+	case res.err != nil && len(addrs) > 0:
+		return addrs, ttl, nil
+	case err != nil:
+		return nil, 0, err
+	case res.err != nil:
+		return nil, 0, res.err
+	}
+	if len(res.addrs) > 0 && (len(addrs) == 0 || res.ttl < ttl) {
+		ttl = res.ttl
+	}
+	addrs = append(addrs, res.addrs...)
+	if len(addrs) == 0 {
+		return nil, 0, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+	return addrs, ttl, nil
+}
+
+// queryDoH sends one RFC 8484 query.
+func (r *Resolver) queryDoH(ctx context.Context, host string, qtype uint16) ([]string, time.Duration, error) {
+	query, err := dnsQuery(host, qtype)
+	if err != nil {
+		return nil, 0, err
+	}
+	var req *http.Request
+	if r.DoHPost {
+		req, err = http.NewRequestWithContext(ctx, "POST", r.DoH, bytes.NewReader(query))
+		if err == nil {
+			req.Header.Set("Content-Type", dohMediaType)
+		}
+	} else {
+		sep := "?"
+		if strings.Contains(r.DoH, "?") {
+			sep = "&"
+		}
+		req, err = http.NewRequestWithContext(ctx, "GET", r.DoH+sep+"dns="+base64.RawURLEncoding.EncodeToString(query), nil)
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	req.Header.Set("Accept", dohMediaType)
+
+	client := r.Client
+	if client == nil {
+		client = dohClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, 0, &net.DNSError{Err: err.Error(), Name: host, Server: r.DoH}
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, 0, &net.DNSError{Err: "DoH server returned " + resp.Status, Name: host, Server: r.DoH}
+	}
+	msg, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxDoHResponse))
+	if err != nil {
+		return nil, 0, &net.DNSError{Err: err.Error(), Name: host, Server: r.DoH}
+	}
+	addrs, ttl, err := parseDNSAnswer(msg, qtype)
+	if err != nil {
+		dnsErr := &net.DNSError{Err: err.Error(), Name: host, Server: r.DoH}
+		if err == errNXDomain {
+			dnsErr.Err = "no such host"
+			dnsErr.IsNotFound = true
+		}
+		return nil, 0, dnsErr
+	}
+	return addrs, ttl, nil
+}
+
+var errNXDomain = errors.New("no such host")
+
+// dnsQuery builds a recursive query message for host. The ID is 0 as
+// RFC 8484 recommends, which keeps GET requests cacheable.
+func dnsQuery(host string, qtype uint16) ([]byte, error) {
+	msg := []byte{0, 0, 1, 0, 0, 1, 0, 0, 0, 0, 0, 0}
+	for _, label := range strings.Split(strings.TrimSuffix(host, "."), ".") {
+		if len(label) == 0 || len(label) > 63 {
+			return nil, &net.DNSError{Err: "invalid host name", Name: host}
+		}
+		msg = append(msg, byte(len(label)))
+		msg = append(msg, label...)
+	}
+	msg = append(msg, 0)
+	msg = binary.BigEndian.AppendUint16(msg, qtype)
+	return binary.BigEndian.AppendUint16(msg, 1), nil
+}
+
+// parseDNSAnswer returns the addresses of qtype records in a response message
+// and their smallest TTL.
+func parseDNSAnswer(msg []byte, qtype uint16) ([]string, time.Duration, error) {
+	if len(msg) < 12 {
+		return nil, 0, errors.New("short DNS response")
+	}
+	if msg[2]&0x80 == 0 {
+		return nil, 0, errors.New("DNS message is not a response")
+	}
+	switch rcode := msg[3] & 0x0f; rcode {
+	case 0:
+	case dnsRcodeNXName:
+		return nil, 0, errNXDomain
+	default:
+		return nil, 0, fmt.Errorf("DNS server failure (rcode %d)", rcode)
+	}
+	qdcount := int(binary.BigEndian.Uint16(msg[4:]))
+	ancount := int(binary.BigEndian.Uint16(msg[6:]))
+	off := 12
+	var err error
+	for i := 0; i < qdcount; i++ {
+		if off, err = skipDNSName(msg, off); err != nil {
+			return nil, 0, err
+		}
+		off += 4
+	}
+	var addrs []string
+	var ttl time.Duration
+	for i := 0; i < ancount; i++ {
+		if off, err = skipDNSName(msg, off); err != nil {
+			return nil, 0, err
+		}
+		if off+10 > len(msg) {
+			return nil, 0, errors.New("truncated DNS response")
+		}
+		typ := binary.BigEndian.Uint16(msg[off:])
+		recTTL := time.Duration(binary.BigEndian.Uint32(msg[off+4:])) * time.Second
+		n := int(binary.BigEndian.Uint16(msg[off+8:]))
+		off += 10
+		if off+n > len(msg) {
+			return nil, 0, errors.New("truncated DNS response")
+		}
+		if typ == qtype && (typ == dnsTypeA && n == net.IPv4len || typ == dnsTypeAAAA && n == net.IPv6len) {
+			addrs = append(addrs, net.IP(msg[off:off+n]).String())
+			if len(addrs) == 1 || recTTL < ttl {
+				ttl = recTTL
+			}
+		}
+		off += n
+	}
+	return addrs, ttl, nil
+}
+
+// skipDNSName returns the offset after the possibly compressed name at off.
+func skipDNSName(msg []byte, off int) (int, error) {
+	for off < len(msg) {
+		n := int(msg[off])
+		switch {
+		case n == 0:
+			return off + 1, nil
+		case n&0xc0 == 0xc0:
+			return off + 2, nil
+		default:
+			off += 1 + n
+		}
+	}
+	return 0, errors.New("truncated DNS response")
+}
@@ -0,0 +1,127 @@
+// Copyright 2015 henrylee2cn Author. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package surfer
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+)
+
+// Error kinds, match them with errors.Is
+var (
+	ErrDNS              = errors.New("surfer: DNS lookup failed")
+	ErrConnectTimeout   = errors.New("surfer: connect timeout")
+	ErrTLS              = errors.New("surfer: TLS handshake failed")
+	ErrProxy            = errors.New("surfer: proxy failed")
+	ErrRedirectLimit    = errors.New("surfer: redirect limit reached")
+	ErrBodyTooLarge     = errors.New("surfer: response body too large")
+	ErrRobotsDisallowed = errors.New("surfer: disallowed by robots.txt")
+	ErrRender           = errors.New("surfer: phantomjs render failed")
+	ErrStatus           = errors.New("surfer: unexpected status code")
+)
+
+// Error is the error of a failed download, errors.Is matches its Kind and
+// errors.As the underlying errors, e.g. *net.DNSError or *url.Error.
+type Error struct {
+	// Kind is one of the Err* kinds, nil when the failure is not classified, e.g. a canceled context
+	Kind error
+	// URL of the request
+	URL string
+	// Attempt counts the download attempts from 1, 0 when none was made
+	Attempt int
+	// DownloaderID is the engine, SurfID or PhomtomJsID
+	DownloaderID int
+	// Err is the underlying error
+	Err error
+}
+
+func (e *Error) Error() string {
+	engine := "surf"
+	if e.DownloaderID == PhomtomJsID {
+		engine = "phantom"
+	}
+	return fmt.Sprintf("surfer: %s download of %s failed (attempt %d): %v", engine, e.URL, e.Attempt, e.Err)
+}
+
+// Unwrap returns the Kind and the underlying error.
+func (e *Error) Unwrap() []error {
+	if e.Kind == nil {
+		return []error{e.Err}
+	}
+	return []error{e.Kind, e.Err}
+}
+
+// newError wraps err into an *Error unless it is one already.
+func (r *Request) newError(engine, attempt int, kind, err error) error {
+	var e *Error
+	if errors.As(err, &e) {
+		return err
+	}
+	return &Error{Kind: kind, URL: r.Url, Attempt: attempt, DownloaderID: engine, Err: err}
+}
+
+// classifyError returns the kind of err, or nil.
+func classifyError(err error) error {
+	for _, kind := range []error{ErrTLS, ErrRobotsDisallowed, ErrRedirectLimit, ErrBodyTooLarge, ErrIdleTimeout, ErrQueueFull, ErrRender, ErrStatus} {
+		if errors.Is(err, kind) {
+			return kind
+		}
+	}
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && (opErr.Op == "proxyconnect" || opErr.Op == "socks5") || errors.Is(err, ErrNoProxy) {
+		return ErrProxy
+	}
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return ErrDNS
+	}
+	if opErr != nil && opErr.Op == "dial" && opErr.Timeout() {
+		return ErrConnectTimeout
+	}
+	var recordErr tls.RecordHeaderError
+	var certErr *tls.CertificateVerificationError
+	var unknownAuthority x509.UnknownAuthorityError
+	var hostnameErr x509.HostnameError
+	if errors.As(err, &recordErr) || errors.As(err, &certErr) || errors.As(err, &unknownAuthority) || errors.As(err, &hostnameErr) {
+		return ErrTLS
+	}
+	return nil
+}
+
+// limitBody fails reads beyond limit bytes with err.
+type limitBody struct {
+	io.ReadCloser
+	remaining int64
+	err       error
+}
+
+func (b *limitBody) Read(p []byte) (int, error) {
+	if b.remaining < 0 {
+		return 0, b.err
+	}
+	if int64(len(p)) > b.remaining+1 {
+		p = p[:b.remaining+1]
+	}
+	n, err := b.ReadCloser.Read(p)
+	b.remaining -= int64(n)
+	if b.remaining < 0 {
+		return n + int(b.remaining), b.err
+	}
+	return n, err
+}
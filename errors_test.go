@@ -0,0 +1,138 @@
+// Copyright 2015 henrylee2cn Author. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package surfer
+
+import (
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestErrors(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/robots.txt":
+			w.Write([]byte("User-agent: *\nDisallow: /private\n"))
+		case "/loop":
+			http.Redirect(w, r, "/loop", http.StatusFound)
+		case "/large":
+			w.Write([]byte("0123456789"))
+		case "/chunked":
+			w.Write([]byte("01234"))
+			w.(http.Flusher).Flush()
+			w.Write([]byte("56789"))
+		}
+	}))
+	defer srv.Close()
+	tlsSrv := httptest.NewTLSServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+	defer tlsSrv.Close()
+	var queries int32
+	dnsServer := serveDNS(t, nil, &queries)
+
+	robots := New().(*Surf)
+	robots.Robots = new(Robots)
+	cases := []struct {
+		name string
+		kind error
+		s    Surfer
+		req  *Request
+	}{
+		{"dns", ErrDNS, &Surf{Resolver: NewResolver(dnsServer)}, &Request{Url: "http://missing.test/"}},
+		{"connect timeout", ErrConnectTimeout, New(), &Request{Url: "http://slow.test/", Resolve: map[string]string{"slow.test": "100::1"}, DialTimeout: 100 * time.Millisecond}},
+		{"tls", ErrTLS, New(), &Request{Url: tlsSrv.URL, TLS: &TLSConfig{Verify: true}}},
+		{"proxy", ErrProxy, New(), &Request{Url: srv.URL, Proxy: "http://127.0.0.1:1"}},
+		{"redirects", ErrRedirectLimit, New(), &Request{Url: srv.URL + "/loop", RedirectTimes: 2}},
+		{"body", ErrBodyTooLarge, New(), &Request{Url: srv.URL + "/large", MaxBodySize: 5}},
+		{"robots", ErrRobotsDisallowed, robots, &Request{Url: srv.URL + "/private"}},
+		{"render", ErrRender, newFakePhantom(t, `echo '{"Error": "Unable to access network"}'`), &Request{Url: srv.URL, DownloaderID: PhomtomJsID}},
+	}
+	for _, c := range cases {
+		c.req.TryTimes = 1
+		_, err := c.s.Download(c.req)
+		var e *Error
+		if !errors.Is(err, c.kind) || !errors.As(err, &e) {
+			t.Errorf("%s: got %v", c.name, err)
+			continue
+		}
+		if e.Kind != c.kind || e.URL != c.req.Url || e.Attempt != 1 || e.DownloaderID != c.req.DownloaderID {
+			t.Errorf("%s: unexpected error fields %+v", c.name, e)
+		}
+	}
+
+	var dnsErr *net.DNSError
+	if _, err := (&Surf{Resolver: NewResolver(dnsServer)}).Download(&Request{Url: "http://missing.test/", TryTimes: 1}); !errors.As(err, &dnsErr) {
+		t.Errorf("the underlying *net.DNSError is lost: %v", err)
+	}
+	var tlsErr *TLSError
+	if _, err := New().Download(&Request{Url: tlsSrv.URL, TLS: &TLSConfig{Verify: true}, TryTimes: 1}); !errors.As(err, &tlsErr) {
+		t.Errorf("expected *TLSError, got %v", err)
+	}
+
+	resp, err := New().Download(&Request{Url: srv.URL + "/chunked", MaxBodySize: 5})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if !errors.Is(err, ErrBodyTooLarge) || string(b) != "01234" {
+		t.Errorf("expected the body to be cut at 5 bytes, got %q %v", b, err)
+	}
+}
+
+func TestStatusError(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Reason", "gone")
+		w.WriteHeader(http.StatusNotFound)
+		w.Write(make([]byte, 2*MaxStatusErrorBody))
+	}))
+	defer srv.Close()
+
+	resp, err := New().Download(&Request{Url: srv.URL})
+	if err != nil {
+		t.Fatalf("status codes are accepted by default, got %v", err)
+	}
+	resp.Body.Close()
+
+	s := New().(*Surf)
+	s.AcceptStatus = Status2xx
+	for _, req := range []*Request{
+		{Url: srv.URL},
+		{Url: srv.URL, AcceptStatus: StatusIn(200, 304)},
+	} {
+		_, err = s.Download(req)
+		var se *StatusError
+		if !errors.Is(err, ErrStatus) || !errors.As(err, &se) {
+			t.Fatalf("expected *StatusError, got %v", err)
+		}
+		if se.StatusCode != 404 || se.Status != "404 Not Found" || se.Header.Get("X-Reason") != "gone" || len(se.Body) != MaxStatusErrorBody {
+			t.Errorf("unexpected status error %d %q %v %d bytes", se.StatusCode, se.Status, se.Header, len(se.Body))
+		}
+	}
+	if _, err = s.Download(&Request{Url: srv.URL, AcceptStatus: StatusIn(404)}); err != nil {
+		t.Errorf("404 should be accepted: %v", err)
+	}
+
+	p := newFakePhantom(t, `echo '{"Body": "ok"}'`)
+	p.AcceptStatus = StatusIn(http.StatusNotFound)
+	resp, err = p.Download(&Request{Url: srv.URL, DownloaderID: PhomtomJsID})
+	var se *StatusError
+	if !errors.As(err, &se) || se.StatusCode != http.StatusOK || string(se.Body) != "ok" || resp.StatusCode != http.StatusOK {
+		t.Errorf("expected a phantom *StatusError, got %v", err)
+	}
+}
@@ -0,0 +1,63 @@
+// Copyright 2015 henrylee2cn Author. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package surfer
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/url"
+)
+
+// ResponseInfo describes how the download attempt that produced a response was made.
+type ResponseInfo struct {
+	// Attempt counts the download attempts from 1
+	Attempt int
+	// Proxy is the proxy actually used, nil for a direct connection
+	Proxy *url.URL
+	// Protocol is the protocol of the response, e.g. "HTTP/2.0"
+	Protocol string
+	// LocalAddr is the local address of the connection, nil if unknown
+	LocalAddr net.Addr
+	// StatusCode is the status code of the attempt's response, 0 if it failed
+	StatusCode int
+	// Timing holds the durations of the attempt's phases; Transfer and Total
+	// are set once the response body has been read or closed
+	Timing Timing
+}
+
+type infoKey struct{}
+
+// Info returns the ResponseInfo of a response returned by a surfer engine, or nil.
+func Info(resp *http.Response) *ResponseInfo {
+	if resp == nil || resp.Request == nil {
+		return nil
+	}
+	info, _ := resp.Request.Context().Value(infoKey{}).(*ResponseInfo)
+	return info
+}
+
+// withInfo returns a context carrying info, so that it reaches resp.Request.
+func withInfo(ctx context.Context, info *ResponseInfo) context.Context {
+	return context.WithValue(ctx, infoKey{}, info)
+}
+
+// attemptOf returns the attempt that produced resp, 0 if unknown.
+func attemptOf(resp *http.Response) int {
+	if info := Info(resp); info != nil {
+		return info.Attempt
+	}
+	return 0
+}
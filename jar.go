@@ -0,0 +1,424 @@
+// Copyright 2015 henrylee2cn Author. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package surfer
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Cookie is a cookie stored in a Jar.
+type Cookie struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+	// Domain is the lower-cased domain without leading dot
+	Domain string `json:"domain"`
+	// HostOnly cookies are sent to Domain only, not to its subdomains
+	HostOnly bool   `json:"hostOnly"`
+	Path     string `json:"path"`
+	// Expires is zero for session cookies
+	Expires  time.Time     `json:"expires,omitempty"`
+	Secure   bool          `json:"secure"`
+	HttpOnly bool          `json:"httpOnly"`
+	SameSite http.SameSite `json:"sameSite,omitempty"`
+	Creation time.Time     `json:"creation"`
+}
+
+// Jar is an RFC 6265 http.CookieJar whose contents can be listed, edited,
+// saved to and loaded from JSON or Netscape cookies.txt files.
+// It has no public suffix list; a Domain attribute must contain a dot unless it is the host itself.
+type Jar struct {
+	mu      sync.Mutex
+	entries map[string]map[string]*Cookie // jarKey -> domain;path;name -> cookie
+}
+
+var _ http.CookieJar = new(Jar)
+
+// NewJar creates an empty Jar.
+func NewJar() *Jar {
+	return &Jar{entries: make(map[string]map[string]*Cookie)}
+}
+
+// jarKey groups the cookies that may be sent to host, by its last two labels.
+func jarKey(host string) string {
+	if net.ParseIP(host) != nil {
+		return host
+	}
+	i := strings.LastIndexByte(host, '.')
+	if i <= 0 {
+		return host
+	}
+	if j := strings.LastIndexByte(host[:i], '.'); j >= 0 {
+		return host[j+1:]
+	}
+	return host
+}
+
+func cookieID(c *Cookie) string {
+	return c.Domain + ";" + c.Path + ";" + c.Name
+}
+
+// canonicalHost returns the lower-cased host of u without port.
+func canonicalHost(u *url.URL) string {
+	return strings.TrimSuffix(strings.ToLower(u.Hostname()), ".")
+}
+
+// SetCookies implements http.CookieJar.
+func (j *Jar) SetCookies(u *url.URL, cookies []*http.Cookie) {
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return
+	}
+	host := canonicalHost(u)
+	if host == "" {
+		return
+	}
+	now := time.Now()
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	for _, hc := range cookies {
+		c := &Cookie{
+			Name:     hc.Name,
+			Value:    hc.Value,
+			Path:     hc.Path,
+			Secure:   hc.Secure,
+			HttpOnly: hc.HttpOnly,
+			SameSite: hc.SameSite,
+			Creation: now,
+		}
+		var ok bool
+		if c.Domain, c.HostOnly, ok = cookieDomain(host, hc.Domain); !ok {
+			continue
+		}
+		if c.Path == "" || c.Path[0] != '/' {
+			c.Path = defaultCookiePath(u.Path)
+		}
+		remove := false
+		switch {
+		case hc.MaxAge < 0:
+			remove = true
+		case hc.MaxAge > 0:
+			c.Expires = now.Add(time.Duration(hc.MaxAge) * time.Second)
+		case !hc.Expires.IsZero():
+			c.Expires = hc.Expires
+			remove = !c.Expires.After(now)
+		}
+		j.put(c, remove)
+	}
+}
+
+// put stores or, when remove is true, deletes c; the caller holds j.mu.
+func (j *Jar) put(c *Cookie, remove bool) {
+	key := jarKey(c.Domain)
+	id := cookieID(c)
+	m := j.entries[key]
+	if remove {
+		if m != nil {
+			delete(m, id)
+			if len(m) == 0 {
+				delete(j.entries, key)
+			}
+		}
+		return
+	}
+	if m == nil {
+		if j.entries == nil {
+			j.entries = make(map[string]map[string]*Cookie)
+		}
+		m = make(map[string]*Cookie)
+		j.entries[key] = m
+	}
+	if old, ok := m[id]; ok && !old.Creation.IsZero() {
+		c.Creation = old.Creation
+	}
+	m[id] = c
+}
+
+// cookieDomain validates the Domain attribute against host, see RFC 6265 section 5.3.
+func cookieDomain(host, domain string) (string, bool, bool) {
+	if domain == "" {
+		return host, true, true
+	}
+	domain = strings.ToLower(strings.TrimPrefix(domain, "."))
+	if domain == "" || strings.HasSuffix(domain, ".") {
+		return "", false, false
+	}
+	if net.ParseIP(host) != nil {
+		return host, true, domain == host
+	}
+	if domain == host {
+		return domain, false, true
+	}
+	if !strings.Contains(domain, ".") || !strings.HasSuffix(host, "."+domain) {
+		return "", false, false
+	}
+	return domain, false, true
+}
+
+// defaultCookiePath computes the default-path of RFC 6265 section 5.1.4.
+func defaultCookiePath(p string) string {
+	if p == "" || p[0] != '/' {
+		return "/"
+	}
+	i := strings.LastIndexByte(p, '/')
+	if i == 0 {
+		return "/"
+	}
+	return p[:i]
+}
+
+// pathMatch implements the path-match of RFC 6265 section 5.1.4.
+func pathMatch(cookiePath, reqPath string) bool {
+	if cookiePath == reqPath {
+		return true
+	}
+	if strings.HasPrefix(reqPath, cookiePath) {
+		return cookiePath[len(cookiePath)-1] == '/' || reqPath[len(cookiePath)] == '/'
+	}
+	return false
+}
+
+// Cookies implements http.CookieJar.
+func (j *Jar) Cookies(u *url.URL) []*http.Cookie {
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil
+	}
+	host := canonicalHost(u)
+	reqPath := u.Path
+	if reqPath == "" {
+		reqPath = "/"
+	}
+	now := time.Now()
+
+	j.mu.Lock()
+	var selected []*Cookie
+	m := j.entries[jarKey(host)]
+	for id, c := range m {
+		if !c.Expires.IsZero() && !c.Expires.After(now) {
+			delete(m, id)
+			continue
+		}
+		if c.HostOnly && host != c.Domain || !c.HostOnly && host != c.Domain && !strings.HasSuffix(host, "."+c.Domain) {
+			continue
+		}
+		if c.Secure && u.Scheme != "https" || !pathMatch(c.Path, reqPath) {
+			continue
+		}
+		selected = append(selected, c)
+	}
+	j.mu.Unlock()
+
+	sort.Slice(selected, func(a, b int) bool {
+		if len(selected[a].Path) != len(selected[b].Path) {
+			return len(selected[a].Path) > len(selected[b].Path)
+		}
+		if !selected[a].Creation.Equal(selected[b].Creation) {
+			return selected[a].Creation.Before(selected[b].Creation)
+		}
+		return selected[a].Name < selected[b].Name
+	})
+	cookies := make([]*http.Cookie, len(selected))
+	for i, c := range selected {
+		cookies[i] = &http.Cookie{Name: c.Name, Value: c.Value}
+	}
+	return cookies
+}
+
+// List returns the unexpired cookies of domain and its subdomains; an empty domain lists all cookies.
+func (j *Jar) List(domain string) []Cookie {
+	domain = strings.ToLower(strings.TrimPrefix(domain, "."))
+	now := time.Now()
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	var list []Cookie
+	for _, m := range j.entries {
+		for _, c := range m {
+			if !c.Expires.IsZero() && !c.Expires.After(now) {
+				continue
+			}
+			if domain == "" || c.Domain == domain || strings.HasSuffix(c.Domain, "."+domain) {
+				list = append(list, *c)
+			}
+		}
+	}
+	sort.Slice(list, func(a, b int) bool {
+		if list[a].Domain != list[b].Domain {
+			return list[a].Domain < list[b].Domain
+		}
+		if list[a].Path != list[b].Path {
+			return list[a].Path < list[b].Path
+		}
+		return list[a].Name < list[b].Name
+	})
+	return list
+}
+
+// Add stores c, replacing the cookie with the same domain, path and name.
+// An empty Path means "/"; an expired c deletes that cookie.
+func (j *Jar) Add(c Cookie) error {
+	c.Domain = strings.ToLower(strings.TrimPrefix(c.Domain, "."))
+	if c.Name == "" || c.Domain == "" {
+		return fmt.Errorf("surfer: cookie needs a name and a domain")
+	}
+	if c.Path == "" {
+		c.Path = "/"
+	}
+	if c.Creation.IsZero() {
+		c.Creation = time.Now()
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.put(&c, !c.Expires.IsZero() && !c.Expires.After(time.Now()))
+	return nil
+}
+
+// Delete removes the cookie with the given domain, path and name, and reports whether it existed.
+func (j *Jar) Delete(domain, path, name string) bool {
+	c := &Cookie{Domain: strings.ToLower(strings.TrimPrefix(domain, ".")), Path: path, Name: name}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	_, ok := j.entries[jarKey(c.Domain)][cookieID(c)]
+	j.put(c, true)
+	return ok
+}
+
+// Clear removes the cookies of domain and its subdomains; an empty domain removes all cookies.
+func (j *Jar) Clear(domain string) {
+	domain = strings.ToLower(strings.TrimPrefix(domain, "."))
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if domain == "" {
+		j.entries = make(map[string]map[string]*Cookie)
+		return
+	}
+	for key, m := range j.entries {
+		for id, c := range m {
+			if c.Domain == domain || strings.HasSuffix(c.Domain, "."+domain) {
+				delete(m, id)
+			}
+		}
+		if len(m) == 0 {
+			delete(j.entries, key)
+		}
+	}
+}
+
+// Clone returns a Jar holding copies of all cookies of j.
+func (j *Jar) Clone() *Jar {
+	clone := NewJar()
+	for _, c := range j.List("") {
+		c := c
+		clone.put(&c, false)
+	}
+	return clone
+}
+
+// SaveJSON writes the unexpired cookies, session cookies included, to w as JSON.
+func (j *Jar) SaveJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(j.List(""))
+}
+
+// LoadJSON adds the cookies saved by SaveJSON to the jar.
+func (j *Jar) LoadJSON(r io.Reader) error {
+	var list []Cookie
+	if err := json.NewDecoder(r).Decode(&list); err != nil {
+		return err
+	}
+	for _, c := range list {
+		if err := j.Add(c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SaveNetscape writes the unexpired cookies to w in the Netscape cookies.txt format
+// used by curl and wget; HttpOnly cookies are prefixed with "#HttpOnly_".
+func (j *Jar) SaveNetscape(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	bw.WriteString("# Netscape HTTP Cookie File\n\n")
+	for _, c := range j.List("") {
+		domain := c.Domain
+		if !c.HostOnly {
+			domain = "." + domain
+		}
+		if c.HttpOnly {
+			domain = "#HttpOnly_" + domain
+		}
+		var expires int64
+		if !c.Expires.IsZero() {
+			expires = c.Expires.Unix()
+		}
+		fmt.Fprintf(bw, "%s\t%s\t%s\t%s\t%d\t%s\t%s\n",
+			domain, netscapeBool(!c.HostOnly), c.Path, netscapeBool(c.Secure), expires, c.Name, c.Value)
+	}
+	return bw.Flush()
+}
+
+// LoadNetscape adds the cookies of a Netscape cookies.txt file to the jar.
+func (j *Jar) LoadNetscape(r io.Reader) error {
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		httpOnly := strings.HasPrefix(line, "#HttpOnly_")
+		if httpOnly {
+			line = line[len("#HttpOnly_"):]
+		} else if line == "" || line[0] == '#' {
+			continue
+		}
+		fields := strings.Split(line, "\t")
+		if len(fields) < 7 {
+			return fmt.Errorf("surfer: cookies.txt line %d: expected 7 fields, got %d", n, len(fields))
+		}
+		expires, err := strconv.ParseInt(fields[4], 10, 64)
+		if err != nil {
+			return fmt.Errorf("surfer: cookies.txt line %d: %v", n, err)
+		}
+		c := Cookie{
+			Domain:   fields[0],
+			HostOnly: !strings.EqualFold(fields[1], "TRUE"),
+			Path:     fields[2],
+			Secure:   strings.EqualFold(fields[3], "TRUE"),
+			Name:     fields[5],
+			Value:    strings.Join(fields[6:], "\t"),
+			HttpOnly: httpOnly,
+		}
+		if expires > 0 {
+			c.Expires = time.Unix(expires, 0)
+		}
+		if err = j.Add(c); err != nil {
+			return fmt.Errorf("surfer: cookies.txt line %d: %v", n, err)
+		}
+	}
+	return scanner.Err()
+}
+
+func netscapeBool(b bool) string {
+	if b {
+		return "TRUE"
+	}
+	return "FALSE"
+}
@@ -0,0 +1,102 @@
+// Copyright 2015 henrylee2cn Author. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package surfer
+
+import (
+	"bytes"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func cookieNames(cookies []*http.Cookie) string {
+	var names []string
+	for _, c := range cookies {
+		names = append(names, c.Name)
+	}
+	return strings.Join(names, ",")
+}
+
+func TestJar(t *testing.T) {
+	jar := NewJar()
+	u, _ := url.Parse("https://www.example.com/app/login")
+	jar.SetCookies(u, []*http.Cookie{
+		{Name: "host", Value: "1"},
+		{Name: "domain", Value: "2", Domain: ".example.com", Path: "/"},
+		{Name: "secure", Value: "3", Secure: true, HttpOnly: true, Expires: time.Now().Add(time.Hour)},
+		{Name: "evil", Value: "4", Domain: "com"},
+		{Name: "other", Value: "5", Domain: "other.com"},
+		{Name: "gone", Value: "6", MaxAge: -1},
+	})
+
+	cases := map[string]string{
+		"https://www.example.com/app/x": "host,secure,domain",
+		"http://www.example.com/app":    "host,domain",
+		"https://sub.example.com/app/x": "domain",
+		"https://www.example.com/other": "domain",
+		"https://example.org/":          "",
+	}
+	for rawurl, want := range cases {
+		u, _ := url.Parse(rawurl)
+		if got := cookieNames(jar.Cookies(u)); got != want {
+			t.Errorf("Cookies(%s) = %q, want %q", rawurl, got, want)
+		}
+	}
+
+	var js, netscape bytes.Buffer
+	if err := jar.SaveJSON(&js); err != nil {
+		t.Fatal(err)
+	}
+	if err := jar.SaveNetscape(&netscape); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(netscape.String(), "#HttpOnly_www.example.com\tFALSE\t/app\tTRUE\t") {
+		t.Errorf("unexpected cookies.txt:\n%s", netscape.String())
+	}
+	for name, load := range map[string]func(*Jar) error{
+		"json":     func(j *Jar) error { return j.LoadJSON(&js) },
+		"netscape": func(j *Jar) error { return j.LoadNetscape(&netscape) },
+	} {
+		loaded := NewJar()
+		if err := load(loaded); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		want, got := jar.List(""), loaded.List("")
+		for i := range got {
+			got[i].Creation, want[i].Creation = time.Time{}, time.Time{}
+			if !got[i].Expires.IsZero() {
+				got[i].Expires, want[i].Expires = time.Unix(got[i].Expires.Unix(), 0), time.Unix(want[i].Expires.Unix(), 0)
+			}
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: loaded %+v, want %+v", name, got, want)
+		}
+	}
+
+	if !jar.Delete("www.example.com", "/app", "host") || len(jar.List("www.example.com")) != 1 {
+		t.Errorf("Delete failed: %+v", jar.List(""))
+	}
+	jar.Add(Cookie{Name: "added", Value: "7", Domain: "example.com"})
+	if got := cookieNames(jar.Cookies(u)); got != "secure,domain,added" {
+		t.Errorf("after Add: %q", got)
+	}
+	jar.Clear("example.com")
+	if len(jar.List("")) != 0 {
+		t.Errorf("Clear left %+v", jar.List(""))
+	}
+}
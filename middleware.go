@@ -0,0 +1,47 @@
+// Copyright 2015 henrylee2cn Author. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package surfer
+
+import (
+	"net/http"
+)
+
+// Handler performs one download attempt.
+type Handler func(*http.Request) (*http.Response, error)
+
+// Middleware wraps the next Handler of the chain, e.g. to modify the request,
+// inspect or reject the response, or return a synthetic response without calling next.
+// It runs once per attempt, retries included.
+type Middleware func(next Handler) Handler
+
+// chain wraps h with mws, the first one being the outermost.
+func chain(mws []Middleware, h Handler) Handler {
+	for i := len(mws) - 1; i >= 0; i-- {
+		h = mws[i](h)
+	}
+	return h
+}
+
+// Use appends middlewares to the chain run by every download attempt.
+// It should be called before the first download.
+func (surf *Surf) Use(mws ...Middleware) {
+	surf.middlewares = append(surf.middlewares, mws...)
+}
+
+// Use appends middlewares to the chain run by every download attempt.
+// It should be called before the first download.
+func (phantom *Phantom) Use(mws ...Middleware) {
+	phantom.middlewares = append(phantom.middlewares, mws...)
+}
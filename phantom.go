@@ -15,15 +15,21 @@
 package surfer
 
 import (
+	"context"
 	"encoding/json"
+	"fmt"
 	"io/ioutil"
 	"log"
 	"mime"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -34,12 +40,33 @@ type (
 	Phantom struct {
 		PhantomjsFile string            //Phantomjs完整文件名
 		TempJsDir     string            //临时js存放目录
+		RetryPolicy   RetryPolicy       //未单独设置RetryPolicy的请求使用，nil时为FixedRetry
+		Limiter       *Limiter          //未单独设置Limiter的请求使用，nil时不限速
+		Trace         TraceFunc         //未单独设置Trace的请求在每次下载尝试结束时调用
+		AcceptStatus  func(int) bool    //未单独设置AcceptStatus的请求使用，nil时接受所有状态码
+		Render        *RenderOptions    //未单独设置Render的请求使用，nil时页面加载完成即输出
+		Workers       int               //常驻phantomjs进程数，0时每次下载尝试启动一个新进程
+		MaxPages      int               //常驻进程渲染多少个页面后重启，0时不限
+		MaxQueue      int               //等待空闲常驻进程的最大请求数，超出时返回ErrQueueFull，0时不限
 		jsFileMap     map[string]string //已存在的js文件
+		middlewares   []Middleware      //每次下载尝试执行的中间件
+		poolMu        sync.Mutex
+		pool          *phantomPool
 	}
 	// Response 用于解析Phantomjs的响应内容
 	Response struct {
-		Cookies []string
-		Body    string
+		Cookies    []string
+		Body       string
+		Error      string
+		Status     int             //主文档的状态码
+		StatusText string          //主文档的状态描述
+		Headers    []PhantomHeader //主文档的响应头
+		URL        string          //跳转后的最终URL
+	}
+	// PhantomHeader 为Phantomjs返回的一条响应头，多个值以换行分隔
+	PhantomHeader struct {
+		Name  string
+		Value string
 	}
 )
 
@@ -68,10 +95,21 @@ func NewPhantom(phantomjsFile, tempJsDir string) Surfer {
 
 // Download 实现surfer下载器接口
 func (phantom *Phantom) Download(req *Request) (resp *http.Response, err error) {
+	return phantom.DownloadContext(context.Background(), req)
+}
+
+// DownloadContext 实现surfer下载器接口，ctx结束时立即杀死phantomjs进程
+func (phantom *Phantom) DownloadContext(ctx context.Context, req *Request) (resp *http.Response, err error) {
+	if req.TLSHandshakeTimeout > 0 {
+		return nil, errPhantomTLSTimeout
+	}
+	req = req.clone()
 	err = req.prepare()
 	if err != nil {
 		return resp, err
 	}
+	ctx, cancel := req.totalContext(ctx)
+	defer cancel()
 	var encoding = "utf-8"
 	if _, params, err := mime.ParseMediaType(req.Header.Get("Content-Type")); err == nil {
 		if cs, ok := params["charset"]; ok {
@@ -79,62 +117,354 @@ func (phantom *Phantom) Download(req *Request) (resp *http.Response, err error)
 		}
 	}
 
-	req.Header.Del("Content-Type")
+	jar := req.cookieJar(nil)
+	if jar != nil {
+		cookies := req.Header["Cookie"]
+		for _, c := range jar.Cookies(req.url) {
+			cookies = append(cookies, c.String())
+		}
+		if len(cookies) > 0 {
+			req.Header.Set("Cookie", strings.Join(cookies, "; "))
+		}
+	}
 
-	var b, _ = req.ReadBody()
+	policy := req.retryPolicy(phantom.RetryPolicy)
+	limiter := req.limiter(phantom.Limiter)
+	traceFunc := req.trace(phantom.Trace)
+	handler := chain(phantom.middlewares, func(httpReq *http.Request) (*http.Response, error) {
+		return phantom.run(httpReq, encoding, req, req.render(phantom.Render))
+	})
+	var attempt int
+	var kind error
+	for attempt = 1; ; attempt++ {
+		var httpReq *http.Request
+		info := &ResponseInfo{Attempt: attempt, Proxy: req.proxy}
+		trace := newAttemptTrace(req, info, traceFunc)
+		if httpReq, err = req.newHTTPRequest(withInfo(ctx, info)); err != nil {
+			break
+		}
+		release := func() {}
+		if limiter != nil {
+			if release, err = limiter.Wait(ctx, req.url); err != nil {
+				err = req.contextError(err)
+				break
+			}
+		}
+		trace.start()
+		resp, err = handler(httpReq)
+		release()
+		// the page is rendered and read completely by phantomjs
+		info.Timing.TTFB = time.Since(info.Timing.Start)
+		if resp != nil {
+			info.StatusCode = resp.StatusCode
+		}
+		trace.finish(err)
+		if ctx.Err() != nil {
+			err = req.contextError(ctx.Err())
+			break
+		}
+		if kind = nil; err != nil {
+			if kind = classifyError(err); kind == nil {
+				kind = ErrRender
+			}
+		}
+		if req.TryTimes > 0 && attempt >= req.TryTimes {
+			break
+		}
+		retry, wait := policy.Retry(req, attempt, resp, err)
+		if !retry {
+			break
+		}
+		discardResponse(resp)
+		resp = nil
+		if err = sleepContext(ctx, wait); err != nil {
+			err = req.contextError(err)
+			break
+		}
+	}
 
-	resp = req.writeback(resp)
+	if err == nil && req.MaxBodySize > 0 && resp.ContentLength > req.MaxBodySize {
+		kind = ErrBodyTooLarge
+		err = fmt.Errorf("body of %d bytes exceeds %d bytes: %w", resp.ContentLength, req.MaxBodySize, ErrBodyTooLarge)
+	}
+	if err != nil {
+		err = req.newError(PhomtomJsID, attempt, kind, err)
+		discardResponse(resp)
+		resp = req.writeback(nil)
+		resp.StatusCode = http.StatusBadGateway
+		resp.Status = err.Error()
+		return resp, err
+	}
+	if jar != nil {
+		// the cookies are those of the final page, after redirects
+		u := req.url
+		if resp.Request != nil {
+			u = resp.Request.URL
+		}
+		jar.SetCookies(u, resp.Cookies())
+	}
+	if statusErr := req.checkStatus(resp, req.acceptStatus(phantom.AcceptStatus)); statusErr != nil {
+		err = req.newError(PhomtomJsID, attempt, ErrStatus, statusErr)
+	}
+	return req.writeback(resp), err
+}
 
-	var args = []string{
-		phantom.jsFileMap["js"],
-		req.Url,
-		req.Header.Get("Cookie"),
-		encoding,
-		req.Header.Get("User-Agent"),
-		string(b),
-		strings.ToLower(req.Method),
+// Close 结束所有常驻phantomjs进程，进行中的下载失败，之后的下载重新启动进程
+func (phantom *Phantom) Close() error {
+	phantom.poolMu.Lock()
+	pool := phantom.pool
+	phantom.pool = nil
+	phantom.poolMu.Unlock()
+	if pool != nil {
+		pool.close()
 	}
+	return nil
+}
 
-	for i := 0; i < req.TryTimes; i++ {
-		cmd := exec.Command(phantom.PhantomjsFile, args...)
-		if resp.Body, err = cmd.StdoutPipe(); err != nil {
-			time.Sleep(req.RetryPause)
-			continue
-		}
-		err = cmd.Start()
-		if err != nil || resp.Body == nil {
-			time.Sleep(req.RetryPause)
-			continue
-		}
-		var b []byte
-		b, err = ioutil.ReadAll(resp.Body)
+// workerPool returns the pool of long-lived workers, nil when Workers is 0.
+func (phantom *Phantom) workerPool() *phantomPool {
+	phantom.poolMu.Lock()
+	defer phantom.poolMu.Unlock()
+	if phantom.pool == nil && phantom.Workers > 0 {
+		phantom.pool = newPhantomPool(phantom.PhantomjsFile, phantom.jsFileMap["js"], phantom.Workers, phantom.MaxPages, phantom.MaxQueue)
+	}
+	return phantom.pool
+}
+
+// run executes phantomjs for one download attempt.
+func (phantom *Phantom) run(req *http.Request, encoding string, param *Request, render *RenderOptions) (*http.Response, error) {
+	var b []byte
+	if req.Body != nil {
+		var err error
+		b, err = ioutil.ReadAll(req.Body)
+		req.Body.Close()
 		if err != nil {
-			time.Sleep(req.RetryPause)
-			continue
+			return nil, err
 		}
-		retResp := Response{}
-		err = json.Unmarshal(b, &retResp)
+	}
+
+	config := newPhantomConfig(req, encoding, b, param)
+	config.Render = newPhantomRender(render)
+	configFile, err := phantom.writeConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(configFile)
+	var out []byte
+	if pool := phantom.workerPool(); pool != nil {
+		out, err = pool.do(req.Context(), configFile)
 		if err != nil {
-			time.Sleep(req.RetryPause)
-			continue
+			return nil, err
 		}
-		resp.Header = req.Header
-		delete(resp.Header, "Set-Cookie")
-		for _, c := range retResp.Cookies {
-			resp.Header.Add("Set-Cookie", c)
+	} else {
+		args := append(phantomProxyArgs(param.proxy), phantom.jsFileMap["js"], configFile)
+		cmd := exec.CommandContext(req.Context(), phantom.PhantomjsFile, args...)
+		if out, err = cmd.Output(); err != nil {
+			return nil, fmt.Errorf("phantomjs: %w", err)
 		}
-		resp.Body = ioutil.NopCloser(strings.NewReader(retResp.Body))
-		break
+	}
+	retResp := Response{}
+	if err = json.Unmarshal(out, &retResp); err != nil {
+		return nil, fmt.Errorf("phantomjs: invalid output: %w", err)
+	}
+	switch retResp.Error {
+	case "":
+	case "idle timeout":
+		return nil, param.contextError(ErrIdleTimeout)
+	default:
+		return nil, fmt.Errorf("%w: %s", ErrRender, retResp.Error)
 	}
 
-	if err == nil {
+	resp := &http.Response{
+		StatusCode:    retResp.Status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        make(http.Header),
+		Body:          ioutil.NopCloser(strings.NewReader(retResp.Body)),
+		ContentLength: int64(len(retResp.Body)),
+		Request:       req,
+	}
+	if resp.StatusCode == 0 {
+		// no response of the main document was seen, e.g. for file:// URLs
 		resp.StatusCode = http.StatusOK
-		resp.Status = http.StatusText(http.StatusOK)
-	} else {
-		resp.StatusCode = http.StatusBadGateway
-		resp.Status = err.Error()
 	}
-	return resp, err
+	statusText := retResp.StatusText
+	if statusText == "" {
+		statusText = http.StatusText(resp.StatusCode)
+	}
+	resp.Status = strconv.Itoa(resp.StatusCode) + " " + statusText
+	for _, h := range retResp.Headers {
+		for _, v := range strings.Split(h.Value, "\n") {
+			resp.Header.Add(h.Name, v)
+		}
+	}
+	// the body is the rendered document, neither encoded nor of the original length
+	resp.Header.Del("Content-Encoding")
+	resp.Header.Del("Content-Length")
+	resp.Header.Del("Set-Cookie")
+	for _, c := range retResp.Cookies {
+		resp.Header.Add("Set-Cookie", c)
+	}
+	if retResp.URL != "" && retResp.URL != req.URL.String() {
+		if u, err := url.Parse(retResp.URL); err == nil {
+			resp.Request = req.Clone(req.Context())
+			resp.Request.URL = u
+			resp.Request.Host = u.Host
+		}
+	}
+	return resp, nil
+}
+
+// phantomConfig is passed to the js script as a JSON file.
+type phantomConfig struct {
+	URL       string `json:"url"`
+	Method    string `json:"method"`
+	Body      string `json:"body"`
+	Encoding  string `json:"encoding"`
+	UserAgent string `json:"userAgent"`
+	// Headers are sent with every request of the page via page.customHeaders
+	Headers map[string]string `json:"headers"`
+	// MainHeaders describe the request itself and are sent with the main document only
+	MainHeaders map[string]string `json:"mainHeaders"`
+	Cookies     []phantomCookie   `json:"cookies"`
+	UserName    string            `json:"userName,omitempty"`
+	Password    string            `json:"password,omitempty"`
+	// Render holds the wait conditions after the page loaded
+	Render *phantomRender `json:"render,omitempty"`
+	// Proxy is set by workers only, a single run gets it on the command line
+	Proxy *phantomProxy `json:"proxy,omitempty"`
+	// timeouts in milliseconds, 0 means none
+	IdleTimeout     int64 `json:"idleTimeout"`
+	ResourceTimeout int64 `json:"resourceTimeout"`
+}
+
+// phantomCookie is the argument of phantom.addCookie.
+type phantomCookie struct {
+	Name   string `json:"name"`
+	Value  string `json:"value"`
+	Domain string `json:"domain"`
+	Path   string `json:"path"`
+}
+
+// newPhantomConfig builds the phantomjs config of one attempt. Cookies are
+// scoped to the requested host, and basic auth credentials, from the URL or
+// the Authorization header, are left to phantomjs to answer the challenge.
+func newPhantomConfig(req *http.Request, encoding string, body []byte, param *Request) *phantomConfig {
+	u := *req.URL
+	config := &phantomConfig{
+		Method:      strings.ToLower(req.Method),
+		Body:        string(body),
+		Encoding:    encoding,
+		UserAgent:   req.Header.Get("User-Agent"),
+		Headers:     make(map[string]string),
+		MainHeaders: make(map[string]string),
+		IdleTimeout: int64(param.IdleReadTimeout / time.Millisecond),
+		Proxy:       newPhantomProxy(param.proxy),
+	}
+	if u.User != nil {
+		config.UserName = u.User.Username()
+		config.Password, _ = u.User.Password()
+		u.User = nil
+	} else if user, pass, ok := req.BasicAuth(); ok {
+		config.UserName, config.Password = user, pass
+	}
+	config.URL = u.String()
+	for name, values := range req.Header {
+		switch name {
+		case "Cookie", "User-Agent", "Host", "Content-Length", "Accept-Encoding":
+		case "Authorization":
+			if config.UserName == "" {
+				config.MainHeaders[name] = strings.Join(values, ", ")
+			}
+		case "Content-Type":
+			config.MainHeaders[name] = strings.Join(values, ", ")
+		default:
+			config.Headers[name] = strings.Join(values, ", ")
+		}
+	}
+	for _, c := range req.Cookies() {
+		config.Cookies = append(config.Cookies, phantomCookie{Name: c.Name, Value: c.Value, Domain: u.Hostname(), Path: "/"})
+	}
+	// phantomjs has a single timeout per resource, a TLSHandshakeTimeout is rejected by DownloadContext
+	config.ResourceTimeout = int64(param.ResponseHeaderTimeout / time.Millisecond)
+	return config
+}
+
+// writeConfig writes config to a temporary file in TempJsDir and returns its name.
+func (phantom *Phantom) writeConfig(config *phantomConfig) (string, error) {
+	b, err := json.Marshal(config)
+	if err != nil {
+		return "", err
+	}
+	f, err := ioutil.TempFile(phantom.TempJsDir, "request-*.json")
+	if err != nil {
+		return "", err
+	}
+	_, err = f.Write(b)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	return f.Name(), nil
+}
+
+// phantomProxy holds the arguments of phantom.setProxy.
+type phantomProxy struct {
+	Host     string `json:"host"`
+	Port     int    `json:"port"`
+	Type     string `json:"type"`
+	User     string `json:"user,omitempty"`
+	Password string `json:"password,omitempty"`
+}
+
+// newPhantomProxy converts proxy for phantomjs, nil for no proxy.
+func newPhantomProxy(proxy *url.URL) *phantomProxy {
+	if proxy == nil {
+		return nil
+	}
+	p := &phantomProxy{Host: proxy.Hostname(), Type: "http"}
+	port := proxy.Port()
+	switch proxy.Scheme {
+	case "socks5", "socks5h":
+		p.Type = "socks5"
+		if port == "" {
+			port = "1080"
+		}
+	case "https":
+		if port == "" {
+			port = "443"
+		}
+	default:
+		if port == "" {
+			port = "80"
+		}
+	}
+	p.Port, _ = strconv.Atoi(port)
+	if proxy.User != nil {
+		p.User = proxy.User.Username()
+		p.Password, _ = proxy.User.Password()
+	}
+	return p
+}
+
+// phantomProxyArgs returns the phantomjs command line options for proxy.
+func phantomProxyArgs(proxy *url.URL) []string {
+	p := newPhantomProxy(proxy)
+	if p == nil {
+		return nil
+	}
+	args := []string{
+		"--proxy=" + net.JoinHostPort(p.Host, strconv.Itoa(p.Port)),
+		"--proxy-type=" + p.Type,
+	}
+	if proxy.User != nil {
+		args = append(args, "--proxy-auth="+p.User+":"+p.Password)
+	}
+	return args
 }
 
 // DestroyJsFiles 销毁js临时文件
@@ -162,49 +492,226 @@ func (phantom *Phantom) createJsFile(fileName, jsCode string) {
 
 /*
 * system.args[0] == js
-* system.args[1] == url
-* system.args[2] == cookie
-* system.args[3] == pageEncode
-* system.args[4] == userAgent
-* system.args[5] == postdata
-* system.args[6] == method
+* system.args[1] == config file, see phantomConfig;
+* without it the script is a worker rendering one config file per line of stdin
  */
 const js string = `
 var system = require('system');
-var page = require('webpage').create();
-var url = system.args[1];
-var cookie = system.args[2];
-var pageEncode = system.args[3];
-var userAgent = system.args[4];
-var postdata = system.args[5];
-var method = system.args[6];
-page.onResourceRequested = function(requestData, request) {
-    request.setHeader('Cookie', cookie)
-};
-phantom.outputEncoding = pageEncode;
-page.settings.userAgent = userAgent;
-page.open(url, method, postdata, function(status) {
-   if (status !== 'success') {
-        console.log('Unable to access network');
-    } else {
+var fs = require('fs');
+var webpage = require('webpage');
+var worker = system.args.length < 2;
+
+function render(config, done) {
+    var page = webpage.create();
+    var lastActivity = Date.now();
+    var idleTimer = null;
+    var finished = false;
+    var finish = function(resp) {
+        if (finished) {
+            return;
+        }
+        finished = true;
+        if (idleTimer !== null) {
+            clearInterval(idleTimer);
+        }
+        console.log(JSON.stringify(resp));
+        page.close();
+        done();
+    };
+    // the main document: the first request and the targets of its redirects
+    var mainIds = {};
+    var mainRedirect = null;
+    var main = {};
+    var firstId = null;
+    // resources requested but not finished, for the network idle wait
+    var pending = {};
+    var pendingCount = 0;
+    var settle = function(id) {
+        if (pending[id]) {
+            delete pending[id];
+            pendingCount--;
+        }
+    };
+    page.onResourceRequested = function(requestData, request) {
+        lastActivity = Date.now();
+        pending[requestData.id] = true;
+        pendingCount++;
+        if (firstId === null) {
+            firstId = requestData.id;
+        }
+        if (requestData.id === firstId || requestData.url === mainRedirect) {
+            mainIds[requestData.id] = true;
+        }
+    };
+    page.onResourceReceived = function(response) {
+        lastActivity = Date.now();
+        if (response.stage === 'end') {
+            settle(response.id);
+        }
+        if (mainIds[response.id]) {
+            main = response;
+            if (response.redirectURL) {
+                mainRedirect = response.redirectURL;
+            }
+        }
+    };
+    page.onResourceError = function(error) {
+        lastActivity = Date.now();
+        settle(error.id);
+    };
+    page.onResourceTimeout = function(request) {
+        lastActivity = Date.now();
+        settle(request.id);
+    };
+    if (config.resourceTimeout > 0) {
+        page.settings.resourceTimeout = config.resourceTimeout;
+    }
+    if (config.idleTimeout > 0) {
+        idleTimer = setInterval(function() {
+            if (Date.now() - lastActivity > config.idleTimeout) {
+                finish({"Error": "idle timeout"});
+            }
+        }, 100);
+    }
+    if (worker) {
+        var p = config.proxy;
+        if (p) {
+            phantom.setProxy(p.host, p.port, p.type, p.user, p.password);
+        } else {
+            phantom.setProxy('');
+        }
+        phantom.clearCookies();
+    }
+    phantom.outputEncoding = config.encoding;
+    page.settings.userAgent = config.userAgent;
+    if (config.userName) {
+        page.settings.userName = config.userName;
+        page.settings.password = config.password;
+    }
+    page.customHeaders = config.headers;
+    (config.cookies || []).forEach(function(c) {
+        phantom.addCookie(c);
+    });
+    var settings = {
+        operation: config.method,
+        data: config.body,
+        headers: config.mainHeaders
+    };
+    var output = function() {
         var cookies = new Array();
         for(var i in page.cookies) {
-        	var cookie = page.cookies[i];
-        	var c = cookie["name"] + "=" + cookie["value"];
-        	for (var obj in cookie){
-        		if(obj == 'name' || obj == 'value'){
-        			continue;
-        		}
-				c +=  "; " +　obj + "=" +  cookie[obj];
-    		}
-			cookies[i] = c;
-		}
-        var resp = {
+            var cookie = page.cookies[i];
+            // a Set-Cookie line: flags are written only when set, as any value would turn them on
+            var c = cookie.name + "=" + cookie.value;
+            if (cookie.domain) {
+                c += "; Domain=" + cookie.domain;
+            }
+            if (cookie.path) {
+                c += "; Path=" + cookie.path;
+            }
+            if (cookie.expiry) {
+                c += "; Expires=" + new Date(cookie.expiry * 1000).toUTCString();
+            }
+            if (cookie.secure) {
+                c += "; Secure";
+            }
+            if (cookie.httponly) {
+                c += "; HttpOnly";
+            }
+            cookies[i] = c;
+        }
+        finish({
             "Cookies": cookies,
-            "Body": page.content
+            "Body": page.content,
+            "Status": main.status || 0,
+            "StatusText": main.statusText || "",
+            "Headers": main.headers || [],
+            "URL": main.url || page.url
+        });
+    };
+    page.open(config.url, settings, function(status) {
+        if (finished) {
+            return;
+        }
+        if (status !== 'success') {
+            finish({"Error": "Unable to access network"});
+            return;
+        }
+        if (!config.render) {
+            output();
+            return;
+        }
+        // the page loaded, the render timeout bounds the rest
+        if (idleTimer !== null) {
+            clearInterval(idleTimer);
+            idleTimer = null;
+        }
+        var opts = config.render;
+        var deadline = Date.now() + opts.timeout;
+        var scrolls = 0;
+        var ready = function() {
+            if (opts.waitSelector && !page.evaluate(function(selector) {
+                return document.querySelector(selector) !== null;
+            }, opts.waitSelector)) {
+                return false;
+            }
+            if (opts.waitExpr && !page.evaluate(function(expr) {
+                try {
+                    return !!eval(expr);
+                } catch (e) {
+                    return false;
+                }
+            }, opts.waitExpr)) {
+                return false;
+            }
+            return !opts.networkIdle || pendingCount === 0 && Date.now() - lastActivity >= opts.networkIdle;
         };
-        console.log(JSON.stringify(resp));
+        var step = function() {
+            if (finished) {
+                return;
+            }
+            if (Date.now() > deadline) {
+                finish({"Error": "render timeout"});
+                return;
+            }
+            if (scrolls < opts.scrolls) {
+                scrolls++;
+                page.evaluate(function() {
+                    window.scrollTo(0, document.body.scrollHeight);
+                });
+                setTimeout(step, opts.scrollWait);
+                return;
+            }
+            if (!ready()) {
+                setTimeout(step, 50);
+                return;
+            }
+            setTimeout(function() {
+                if (!finished) {
+                    output();
+                }
+            }, opts.delay);
+        };
+        step();
+    });
+}
+
+function next() {
+    var line = system.stdin.readLine();
+    if (!line) {
+        phantom.exit();
+        return;
     }
-    phantom.exit();
-});
+    render(JSON.parse(fs.read(line)), function() {
+        setTimeout(next, 0);
+    });
+}
+
+if (worker) {
+    next();
+} else {
+    render(JSON.parse(fs.read(system.args[1])), function() {
+        phantom.exit();
+    });
+}
 `
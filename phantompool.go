@@ -0,0 +1,210 @@
+// Copyright 2015 henrylee2cn Author. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package surfer
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os/exec"
+	"sync"
+	"sync/atomic"
+)
+
+// ErrQueueFull is the kind of error returned when Phantom.MaxQueue requests are already waiting for a worker.
+var ErrQueueFull = errors.New("surfer: phantomjs worker queue is full")
+
+// phantomPool runs jobs on long-lived phantomjs workers reading config files from stdin.
+type phantomPool struct {
+	file     string
+	js       string
+	maxPages int
+	maxQueue int
+	// slots holds one entry per worker, nil for a worker not started yet
+	slots   chan *phantomWorker
+	waiting int32
+
+	mu      sync.Mutex
+	closed  bool
+	workers map[*phantomWorker]bool
+}
+
+func newPhantomPool(file, js string, size, maxPages, maxQueue int) *phantomPool {
+	pool := &phantomPool{
+		file:     file,
+		js:       js,
+		maxPages: maxPages,
+		maxQueue: maxQueue,
+		slots:    make(chan *phantomWorker, size),
+		workers:  make(map[*phantomWorker]bool),
+	}
+	for i := 0; i < size; i++ {
+		pool.slots <- nil
+	}
+	return pool
+}
+
+// do renders configFile on an idle worker, waiting for one until ctx is done.
+func (pool *phantomPool) do(ctx context.Context, configFile string) ([]byte, error) {
+	var w *phantomWorker
+	select {
+	case w = <-pool.slots:
+	default:
+		if n := atomic.AddInt32(&pool.waiting, 1); pool.maxQueue > 0 && int(n) > pool.maxQueue {
+			atomic.AddInt32(&pool.waiting, -1)
+			return nil, ErrQueueFull
+		}
+		select {
+		case w = <-pool.slots:
+			atomic.AddInt32(&pool.waiting, -1)
+		case <-ctx.Done():
+			atomic.AddInt32(&pool.waiting, -1)
+			return nil, ctx.Err()
+		}
+	}
+	var err error
+	if w != nil && w.exited() {
+		// died while idle, e.g. killed from outside
+		pool.stop(w)
+		w = nil
+	}
+	if w == nil {
+		if w, err = pool.start(); err != nil {
+			pool.slots <- nil
+			return nil, err
+		}
+	}
+	out, err := w.do(ctx, configFile)
+	if err != nil || pool.maxPages > 0 && w.pages >= pool.maxPages {
+		// crashed, killed, out of step or used up: the next job starts a fresh worker
+		pool.stop(w)
+		w = nil
+	}
+	pool.slots <- w
+	return out, err
+}
+
+// start launches a worker.
+func (pool *phantomPool) start() (*phantomWorker, error) {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+	if pool.closed {
+		return nil, errors.New("phantomjs: worker pool is closed")
+	}
+	cmd := exec.Command(pool.file, pool.js)
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err = cmd.Start(); err != nil {
+		return nil, fmt.Errorf("phantomjs: %w", err)
+	}
+	w := &phantomWorker{cmd: cmd, stdin: stdin, stdout: bufio.NewReader(stdout), done: make(chan struct{})}
+	go func() {
+		cmd.Wait()
+		close(w.done)
+	}()
+	pool.workers[w] = true
+	return w, nil
+}
+
+// stop kills a worker.
+func (pool *phantomPool) stop(w *phantomWorker) {
+	pool.mu.Lock()
+	delete(pool.workers, w)
+	pool.mu.Unlock()
+	w.kill()
+}
+
+// close kills all workers, busy ones fail their job.
+func (pool *phantomPool) close() {
+	pool.mu.Lock()
+	pool.closed = true
+	workers := pool.workers
+	pool.workers = make(map[*phantomWorker]bool)
+	pool.mu.Unlock()
+	for w := range workers {
+		w.kill()
+	}
+}
+
+// phantomWorker is one phantomjs process, rendering one page at a time.
+type phantomWorker struct {
+	cmd    *exec.Cmd
+	stdin  io.WriteCloser
+	stdout *bufio.Reader
+	pages  int
+	once   sync.Once
+	// done is closed once the process exited
+	done chan struct{}
+}
+
+// do sends configFile to the worker and reads the output line; when ctx is
+// done first the worker is killed, as the page cannot be aborted otherwise.
+func (w *phantomWorker) do(ctx context.Context, configFile string) ([]byte, error) {
+	w.pages++
+	if _, err := io.WriteString(w.stdin, configFile+"\n"); err != nil {
+		return nil, fmt.Errorf("phantomjs: worker exited: %w", err)
+	}
+	type result struct {
+		line []byte
+		err  error
+	}
+	done := make(chan result, 1)
+	go func() {
+		line, err := w.stdout.ReadBytes('\n')
+		done <- result{line, err}
+	}()
+	select {
+	case r := <-done:
+		if r.err != nil {
+			return nil, fmt.Errorf("phantomjs: worker exited: %w", r.err)
+		}
+		if !json.Valid(r.line) {
+			// whatever the page printed next would be taken for the next job's output
+			return nil, fmt.Errorf("%w: phantomjs worker printed %q", ErrRender, r.line)
+		}
+		return r.line, nil
+	case <-ctx.Done():
+		w.kill()
+		<-done
+		return nil, ctx.Err()
+	}
+}
+
+// exited reports whether the process has exited.
+func (w *phantomWorker) exited() bool {
+	select {
+	case <-w.done:
+		return true
+	default:
+		return false
+	}
+}
+
+func (w *phantomWorker) kill() {
+	w.once.Do(func() {
+		w.stdin.Close()
+		w.cmd.Process.Kill()
+		<-w.done
+	})
+}
@@ -0,0 +1,139 @@
+// Copyright 2015 henrylee2cn Author. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package surfer
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestPhantomWorkers(t *testing.T) {
+	p := newFakePhantom(t, `[ $# -eq 1 ] || exit 1
+while read f; do
+	case "$(cat "$f")" in
+	*crash*) exit 1;;
+	*slow*) sleep 1;;
+	esac
+	echo "{\"Body\": \"$$\"}"
+done
+`)
+	p.Workers, p.MaxPages = 1, 2
+	defer p.Close()
+	pid := func(path string) (string, error) {
+		resp, err := p.Download(&Request{Url: "http://example.com" + path, DownloaderID: PhomtomJsID, TryTimes: 1})
+		if err != nil {
+			return "", err
+		}
+		b, _ := ioutil.ReadAll(resp.Body)
+		return string(b), nil
+	}
+
+	var pids []string
+	for i := 0; i < 3; i++ {
+		id, err := pid("/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		pids = append(pids, id)
+	}
+	if pids[0] != pids[1] || pids[1] == pids[2] {
+		t.Errorf("worker not reused for %d pages, then recycled: %v", p.MaxPages, pids)
+	}
+
+	if _, err := pid("/crash"); !errors.Is(err, ErrRender) {
+		t.Errorf("crash: got %v", err)
+	}
+	if id, err := pid("/"); err != nil || id == pids[2] {
+		t.Errorf("crashed worker not replaced: %s %v", id, err)
+	}
+
+	p.MaxQueue = 1
+	p.Close()
+	pool := p.workerPool()
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := pid("/slow"); err != nil {
+				t.Error(err)
+			}
+		}()
+		for deadline := time.Now().Add(time.Second); len(pool.slots) != 0 || i == 1 && atomic.LoadInt32(&pool.waiting) != 1; {
+			if time.Now().After(deadline) {
+				t.Fatal("request not started")
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+	if _, err := pid("/"); !errors.Is(err, ErrQueueFull) {
+		t.Errorf("queue full: got %v", err)
+	}
+	wg.Wait()
+}
+
+func TestPhantomWorkerFailures(t *testing.T) {
+	p, records := newMockPhantom(t, map[string]mockPage{
+		"/":        {Content: "ok"},
+		"/crash":   {Crash: true, Load: 50},
+		"/garbage": {Garbage: "Fontconfig warning: ignoring UTF-8", Content: "stale"},
+	})
+	p.Workers = 1
+	defer p.Close()
+	download := func(path string) (string, error) {
+		resp, err := p.Download(&Request{Url: "http://example.com" + path, DownloaderID: PhomtomJsID, TryTimes: 1})
+		if err != nil {
+			return "", err
+		}
+		b, _ := BodyBytes(resp)
+		return string(b), nil
+	}
+	pids := func() (pids []int) {
+		for _, r := range records() {
+			pids = append(pids, r.Pid)
+		}
+		return pids
+	}
+
+	for _, path := range []string{"/crash", "/garbage"} {
+		if _, err := download(path); !errors.Is(err, ErrRender) {
+			t.Errorf("%s: expected a render error, got %v", path, err)
+		}
+		if n := len(p.workerPool().slots); n != 1 {
+			t.Fatalf("%s: the worker did not free its slot", path)
+		}
+		// the next page gets its own output from a fresh worker
+		if body, err := download("/"); err != nil || body != "ok" {
+			t.Errorf("after %s: got %q, %v", path, body, err)
+		}
+		if ids := pids(); ids[len(ids)-1] == ids[len(ids)-2] {
+			t.Errorf("after %s: the worker was not replaced: %v", path, ids)
+		}
+	}
+
+	// a worker dying while idle is replaced before it is given a page
+	ids := pids()
+	proc, _ := os.FindProcess(ids[len(ids)-1])
+	proc.Kill()
+	time.Sleep(100 * time.Millisecond)
+	if body, err := download("/"); err != nil || body != "ok" {
+		t.Errorf("after the idle worker died: got %q, %v", body, err)
+	}
+}
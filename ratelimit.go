@@ -0,0 +1,265 @@
+// Copyright 2015 henrylee2cn Author. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package surfer
+
+import (
+	"context"
+	"io"
+	"math/rand"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Limiter throttles downloads per key, which is the request host by default.
+// It combines a token bucket (Rate/Burst), a politeness delay between the
+// starts of two requests (MinDelay/Jitter) and a cap on in-flight requests.
+// The state of a key is dropped once it is idle, so crawling many hosts does not grow it.
+// The zero value does not limit anything; a Limiter must not be copied after first use.
+type Limiter struct {
+	// Rate is the number of requests per second allowed per key, 0 means no limit
+	Rate float64
+	// Burst is the number of requests that may start at once, 0 means 1
+	Burst int
+	// MinDelay is the least pause between the starts of two requests with the same key
+	MinDelay time.Duration
+	// Jitter adds a random pause of up to Jitter to every MinDelay
+	Jitter time.Duration
+	// MaxConcurrent limits the in-flight requests per key, 0 means no limit
+	MaxConcurrent int
+	// Key maps a request URL to its throttling key, nil means HostKey
+	Key func(*url.URL) string
+
+	mu    sync.Mutex
+	hosts map[string]*hostLimit
+	// sweepAt is the number of keys at which the idle ones are dropped
+	sweepAt int
+}
+
+// minLimiterSweep is the least number of keys before the idle ones are dropped.
+const minLimiterSweep = 64
+
+// hostLimit is the throttling state of one key.
+type hostLimit struct {
+	tokens float64
+	last   time.Time     // last token refill
+	next   time.Time     // earliest start allowed by the delay
+	delay  time.Duration // overrides MinDelay when longer, e.g. robots.txt Crawl-delay
+	sem    chan struct{}
+	active int  // requests waiting or in flight
+	pinned bool // the delay was set with SetDelay
+}
+
+// HostKey is the default Limiter key: the lower-cased host[:port] of u.
+func HostKey(u *url.URL) string {
+	return strings.ToLower(u.Host)
+}
+
+// Wait blocks until a request to u may start or ctx is done.
+// On success the returned release must be called once the request has completed.
+func (l *Limiter) Wait(ctx context.Context, u *url.URL) (release func(), err error) {
+	key := l.key(u)
+	h := l.acquire(key)
+
+	var once sync.Once
+	release = func() {
+		once.Do(func() {
+			if h.sem != nil {
+				<-h.sem
+			}
+			l.done(key, h)
+		})
+	}
+	if h.sem != nil {
+		select {
+		case h.sem <- struct{}{}:
+		case <-ctx.Done():
+			l.done(key, h)
+			return nil, ctx.Err()
+		}
+	}
+
+	if wait, cancel := l.reserve(h); wait > 0 {
+		if err = sleepContext(ctx, wait); err != nil {
+			cancel()
+			release()
+			return nil, err
+		}
+	}
+	return release, nil
+}
+
+// SetDelay sets a per-key politeness delay used instead of MinDelay when it is longer.
+func (l *Limiter) SetDelay(key string, d time.Duration) {
+	l.mu.Lock()
+	h := l.host(key)
+	h.delay, h.pinned = d, true
+	l.mu.Unlock()
+}
+
+// crawlDelay sets the delay of key like SetDelay, but only for the next
+// request: Robots sets it again before each of them.
+func (l *Limiter) crawlDelay(key string, d time.Duration) {
+	l.mu.Lock()
+	l.host(key).delay = d
+	l.mu.Unlock()
+}
+
+func (l *Limiter) key(u *url.URL) string {
+	if l.Key != nil {
+		return l.Key(u)
+	}
+	return HostKey(u)
+}
+
+// acquire returns the state of key, counting one more request using it.
+func (l *Limiter) acquire(key string) *hostLimit {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	h := l.host(key)
+	h.active++
+	return h
+}
+
+// done counts a request of key out and forgets the state of key once it is idle.
+func (l *Limiter) done(key string, h *hostLimit) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	h.active--
+	if l.idle(h, time.Now()) && l.hosts[key] == h {
+		delete(l.hosts, key)
+	}
+}
+
+// host returns the state of key, creating it on first use; l.mu must be held.
+// Every time the number of keys doubled, the idle ones are dropped.
+func (l *Limiter) host(key string) *hostLimit {
+	h, ok := l.hosts[key]
+	if !ok {
+		if len(l.hosts) >= l.sweepAt {
+			now := time.Now()
+			for k, h := range l.hosts {
+				if l.idle(h, now) {
+					delete(l.hosts, k)
+				}
+			}
+			l.sweepAt = 2 * len(l.hosts)
+			if l.sweepAt < minLimiterSweep {
+				l.sweepAt = minLimiterSweep
+			}
+		}
+		h = &hostLimit{tokens: float64(l.burst()), last: time.Now()}
+		if l.MaxConcurrent > 0 {
+			h.sem = make(chan struct{}, l.MaxConcurrent)
+		}
+		if l.hosts == nil {
+			l.hosts = make(map[string]*hostLimit)
+		}
+		l.hosts[key] = h
+	}
+	return h
+}
+
+// idle reports whether h is in the state a new key starts with, so it can be
+// dropped: no request using it, its token bucket full again and its delay over.
+// A delay set with SetDelay is kept. l.mu must be held.
+func (l *Limiter) idle(h *hostLimit, now time.Time) bool {
+	if h.active > 0 || h.pinned || h.next.After(now) {
+		return false
+	}
+	if h.delay > 0 && h.next.IsZero() {
+		// the crawl delay of a request yet to come
+		return false
+	}
+	return l.Rate <= 0 || h.tokens+now.Sub(h.last).Seconds()*l.Rate >= float64(l.burst())
+}
+
+func (l *Limiter) burst() int {
+	if l.Burst <= 0 {
+		return 1
+	}
+	return l.Burst
+}
+
+// reserve books the next start slot of h and returns how long to wait for it,
+// and a func giving the slot back when the wait is abandoned.
+func (l *Limiter) reserve(h *hostLimit) (time.Duration, func()) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	start := now
+	prevNext := h.next
+
+	if l.Rate > 0 {
+		h.tokens += now.Sub(h.last).Seconds() * l.Rate
+		if max := float64(l.burst()); h.tokens > max {
+			h.tokens = max
+		}
+		h.last = now
+		h.tokens--
+		if h.tokens < 0 {
+			start = now.Add(time.Duration(-h.tokens / l.Rate * float64(time.Second)))
+		}
+	}
+
+	if h.next.After(start) {
+		start = h.next
+	}
+	delay := l.MinDelay
+	if h.delay > delay {
+		delay = h.delay
+	}
+	if delay > 0 || l.Jitter > 0 {
+		if l.Jitter > 0 {
+			delay += time.Duration(rand.Int63n(int64(l.Jitter) + 1))
+		}
+		h.next = start.Add(delay)
+	}
+	next := h.next
+	cancel := func() {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		if l.Rate > 0 {
+			h.tokens++
+		}
+		// later reservations keep their slots, they are already waiting for them
+		if h.next.Equal(next) {
+			h.next = prevNext
+		}
+	}
+	return start.Sub(now), cancel
+}
+
+// limiter returns the Limiter in effect, the request's own one overriding the engine's.
+func (r *Request) limiter(engine *Limiter) *Limiter {
+	if r.Limiter != nil {
+		return r.Limiter
+	}
+	return engine
+}
+
+// releaseBody calls release once the response body is closed.
+type releaseBody struct {
+	io.ReadCloser
+	once    sync.Once
+	release func()
+}
+
+func (b *releaseBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(b.release)
+	return err
+}
@@ -0,0 +1,138 @@
+// Copyright 2015 henrylee2cn Author. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package surfer
+
+import (
+	"context"
+	"errors"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestLimiter(t *testing.T) {
+	a, _ := url.Parse("http://a.example.com/x")
+	b, _ := url.Parse("http://b.example.com/x")
+	l := &Limiter{MinDelay: 50 * time.Millisecond, MaxConcurrent: 1}
+	ctx := context.Background()
+
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		release, err := l.Wait(ctx, a)
+		if err != nil {
+			t.Fatal(err)
+		}
+		release()
+	}
+	if d := time.Since(start); d < 100*time.Millisecond {
+		t.Fatalf("expected politeness delay, 3 requests took %v", d)
+	}
+
+	start = time.Now()
+	release, err := l.Wait(ctx, b)
+	if err != nil || time.Since(start) > 20*time.Millisecond {
+		t.Fatalf("other host should not wait: %v", err)
+	}
+
+	timeout, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer cancel()
+	if _, err = l.Wait(timeout, b); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected MaxConcurrent to block until the deadline, got %v", err)
+	}
+	release()
+}
+
+func TestLimiterRate(t *testing.T) {
+	u, _ := url.Parse("http://example.com/")
+	l := &Limiter{Rate: 20, Burst: 2}
+	start := time.Now()
+	for i := 0; i < 4; i++ {
+		release, err := l.Wait(context.Background(), u)
+		if err != nil {
+			t.Fatal(err)
+		}
+		release()
+	}
+	if d := time.Since(start); d < 90*time.Millisecond {
+		t.Fatalf("expected 2 requests to wait for tokens, took %v", d)
+	}
+}
+
+func TestLimiterCancel(t *testing.T) {
+	u, _ := url.Parse("http://example.com/")
+	l := &Limiter{MinDelay: 300 * time.Millisecond}
+	start := time.Now()
+	if _, err := l.Wait(context.Background(), u); err != nil {
+		t.Fatal(err)
+	}
+	timeout, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := l.Wait(timeout, u); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected the deadline, got %v", err)
+	}
+	// the abandoned slot is given back, the next request takes it
+	if _, err := l.Wait(context.Background(), u); err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(start); d < 250*time.Millisecond || d > 450*time.Millisecond {
+		t.Errorf("expected to start after one delay, took %v", d)
+	}
+}
+
+func TestLimiterForgetsIdleHosts(t *testing.T) {
+	l := &Limiter{MinDelay: 20 * time.Millisecond}
+	wait := func(host string) {
+		u, _ := url.Parse("http://" + host + "/")
+		release, err := l.Wait(context.Background(), u)
+		if err != nil {
+			t.Fatal(err)
+		}
+		release()
+	}
+	for i := 0; i < 200; i++ {
+		wait(strconv.Itoa(i) + ".example.com")
+	}
+	// the delays are still running, every host is kept
+	if n := len(l.hosts); n != 200 {
+		t.Fatalf("expected 200 hosts in their delay, got %d", n)
+	}
+	time.Sleep(30 * time.Millisecond)
+	for i := 0; i < 100; i++ {
+		wait(strconv.Itoa(i) + ".example.org")
+	}
+	if n := len(l.hosts); n > 128 {
+		t.Errorf("idle hosts not dropped: %d left", n)
+	}
+
+	// a host without a delay is dropped once its request is released,
+	// unless a delay was set for it
+	l = &Limiter{MaxConcurrent: 2}
+	l.SetDelay("slow.example.com", time.Millisecond)
+	wait("example.com")
+	if _, ok := l.hosts["example.com"]; ok || len(l.hosts) != 1 {
+		t.Errorf("unexpected hosts %v", l.hosts)
+	}
+	// a robots.txt Crawl-delay is set again before every request, it is not kept
+	l.crawlDelay("crawl.example.com", time.Millisecond)
+	if l.idle(l.hosts["crawl.example.com"], time.Now()) {
+		t.Error("the crawl delay was dropped before its request")
+	}
+	wait("crawl.example.com")
+	later := time.Now().Add(time.Second)
+	if !l.idle(l.hosts["crawl.example.com"], later) || l.idle(l.hosts["slow.example.com"], later) {
+		t.Error("only the delay set with SetDelay should be kept")
+	}
+}
@@ -0,0 +1,87 @@
+// Copyright 2015 henrylee2cn Author. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package surfer
+
+import (
+	"time"
+)
+
+// constant
+const (
+	DefaultRenderTimeout = 30 * time.Second       // 设置了等待条件时默认的最长渲染时间
+	DefaultScrollWait    = 500 * time.Millisecond // 每次滚动后默认的等待时间
+)
+
+// RenderOptions tells the phantom engine how long to wait after the page loaded
+// before taking its content: it scrolls first, then waits until all set conditions
+// hold, then sleeps Delay. Rendering fails with ErrRender after Timeout.
+type RenderOptions struct {
+	// scrolls to the bottom this many times, for infinite-scroll pages
+	Scrolls int
+	// the pause after each scroll (0 means DefaultScrollWait)
+	ScrollWait time.Duration
+	// waits until an element matches this CSS selector
+	WaitSelector string
+	// waits until this JavaScript expression is truthy, e.g. "window.appReady"
+	WaitExpr string
+	// waits until no resource was pending for this long
+	NetworkIdle time.Duration
+	// a fixed pause before taking the content
+	Delay time.Duration
+	// the limit of rendering after the page loaded (0 means DefaultRenderTimeout)
+	Timeout time.Duration
+}
+
+// render returns the RenderOptions in effect, the request's own ones overriding the engine's.
+func (r *Request) render(engine *RenderOptions) *RenderOptions {
+	if r.Render != nil {
+		return r.Render
+	}
+	return engine
+}
+
+// phantomRender is RenderOptions in milliseconds for the js script.
+type phantomRender struct {
+	Scrolls      int    `json:"scrolls"`
+	ScrollWait   int64  `json:"scrollWait"`
+	WaitSelector string `json:"waitSelector"`
+	WaitExpr     string `json:"waitExpr"`
+	NetworkIdle  int64  `json:"networkIdle"`
+	Delay        int64  `json:"delay"`
+	Timeout      int64  `json:"timeout"`
+}
+
+// newPhantomRender converts opts with the defaults applied, nil for none.
+func newPhantomRender(opts *RenderOptions) *phantomRender {
+	if opts == nil {
+		return nil
+	}
+	r := &phantomRender{
+		Scrolls:      opts.Scrolls,
+		ScrollWait:   int64(opts.ScrollWait / time.Millisecond),
+		WaitSelector: opts.WaitSelector,
+		WaitExpr:     opts.WaitExpr,
+		NetworkIdle:  int64(opts.NetworkIdle / time.Millisecond),
+		Delay:        int64(opts.Delay / time.Millisecond),
+		Timeout:      int64(opts.Timeout / time.Millisecond),
+	}
+	if opts.ScrollWait == 0 {
+		r.ScrollWait = int64(DefaultScrollWait / time.Millisecond)
+	}
+	if opts.Timeout == 0 {
+		r.Timeout = int64(DefaultRenderTimeout / time.Millisecond)
+	}
+	return r
+}
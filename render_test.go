@@ -0,0 +1,76 @@
+// Copyright 2015 henrylee2cn Author. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package surfer
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestRenderOptions(t *testing.T) {
+	p, _ := newMockPhantom(t, map[string]mockPage{
+		"/app":    {Content: "<ul><li>1</li></ul>", Elements: map[string]int{"#list li": 300}},
+		"/ready":  {Vars: map[string]int{"appReady": 300}},
+		"/busy":   {Resources: []mockResource{{At: 0, Duration: 300}}},
+		"/feed":   {Content: "scrolled {scrolls} times"},
+		"/static": {},
+	})
+	render := func(path string, opts *RenderOptions) (string, time.Duration, error) {
+		start := time.Now()
+		resp, err := p.Download(&Request{Url: "http://example.com" + path, Render: opts, DownloaderID: PhomtomJsID, TryTimes: 1})
+		if err != nil {
+			return "", time.Since(start), err
+		}
+		b, _ := BodyBytes(resp)
+		return string(b), time.Since(start), nil
+	}
+
+	body, took, err := render("/app", &RenderOptions{WaitSelector: "#list li"})
+	if err != nil || body != "<ul><li>1</li></ul>" || took < 300*time.Millisecond {
+		t.Errorf("selector wait: %q after %v, %v", body, took, err)
+	}
+	_, took, err = render("/app", &RenderOptions{WaitSelector: "#missing", Timeout: 200 * time.Millisecond})
+	if !errors.Is(err, ErrRender) || took > 2*time.Second {
+		t.Errorf("expected a render timeout, got %v after %v", err, took)
+	}
+	if _, took, err = render("/ready", &RenderOptions{WaitExpr: "window.appReady"}); err != nil || took < 300*time.Millisecond {
+		t.Errorf("expression wait: %v after %v", err, took)
+	}
+	if _, took, err = render("/busy", &RenderOptions{NetworkIdle: 100 * time.Millisecond}); err != nil || took < 400*time.Millisecond {
+		t.Errorf("network idle wait: %v after %v", err, took)
+	}
+	if body, _, err = render("/feed", &RenderOptions{Scrolls: 3, ScrollWait: 10 * time.Millisecond}); err != nil || body != "scrolled 3 times" {
+		t.Errorf("scrolls: %q, %v", body, err)
+	}
+
+	p.Render = &RenderOptions{Delay: 300 * time.Millisecond}
+	if _, took, err = render("/static", nil); err != nil || took < 300*time.Millisecond {
+		t.Errorf("engine delay: %v after %v", err, took)
+	}
+	if _, took, err = render("/static", &RenderOptions{}); err != nil || took > 300*time.Millisecond {
+		t.Errorf("request options override the engine's: %v after %v", err, took)
+	}
+}
+
+func TestNewPhantomRender(t *testing.T) {
+	want := phantomRender{ScrollWait: 500, Delay: 1000, Timeout: 30000}
+	if r := newPhantomRender(&RenderOptions{Delay: time.Second}); r == nil || *r != want {
+		t.Errorf("got %+v, want %+v", r, want)
+	}
+	if r := newPhantomRender(nil); r != nil {
+		t.Errorf("no options: got %+v", r)
+	}
+}
@@ -0,0 +1,223 @@
+// Copyright 2015 henrylee2cn Author. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package surfer
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// constant
+const (
+	DefaultDNSTTL         = time.Minute      // 默认DNS解析结果缓存时长
+	DefaultDNSNegativeTTL = 10 * time.Second // 默认域名不存在时的缓存时长
+	maxDNSEntries         = 4096             // 超过后清理过期的缓存项
+)
+
+// Resolver is a caching DNS resolver for the Surf engine.
+// Lookups of the same host share one query, successful answers are kept
+// for TTL and "no such host" answers for NegativeTTL; other failures,
+// such as timeouts, are not cached.
+type Resolver struct {
+	// Server is the DNS server to query as "host:port" (port 53 when omitted), empty uses the system resolver
+	Server string
+	// DoH is a DNS-over-HTTPS (RFC 8484) endpoint URL, used instead of Server when set
+	DoH string
+	// DoHPost sends DoH queries with POST instead of GET
+	DoHPost bool
+	// Fallback resolves with the system resolver when a DoH query fails;
+	// "no such host" answers are final
+	Fallback bool
+	// Client sends the DoH queries, nil uses a client with a 10s timeout
+	Client *http.Client
+	// TTL of successful lookups, 0 means DefaultDNSTTL; DoH answers are kept for their own TTL up to this
+	TTL time.Duration
+	// NegativeTTL of "no such host" answers, 0 means DefaultDNSNegativeTTL, negative disables negative caching
+	NegativeTTL time.Duration
+
+	once     sync.Once
+	resolver *net.Resolver
+	mu       sync.Mutex
+	cache    map[string]*dnsEntry
+}
+
+type dnsEntry struct {
+	done    chan struct{}
+	addrs   []string
+	err     error
+	expires time.Time
+}
+
+// NewResolver returns a caching Resolver querying the DNS server, empty for the system resolver.
+func NewResolver(server string) *Resolver {
+	return &Resolver{Server: server}
+}
+
+// LookupHost returns the addresses of host, from the cache when fresh.
+func (r *Resolver) LookupHost(ctx context.Context, host string) ([]string, error) {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	if net.ParseIP(host) != nil {
+		return []string{host}, nil
+	}
+	now := time.Now()
+	r.mu.Lock()
+	e, ok := r.cache[host]
+	if ok {
+		select {
+		case <-e.done:
+			if now.After(e.expires) {
+				ok = false
+			}
+		default:
+		}
+	}
+	if !ok {
+		if r.cache == nil {
+			r.cache = make(map[string]*dnsEntry)
+		} else if len(r.cache) >= maxDNSEntries {
+			r.prune(now)
+		}
+		e = &dnsEntry{done: make(chan struct{})}
+		r.cache[host] = e
+		r.mu.Unlock()
+		go r.fill(host, e)
+	} else {
+		r.mu.Unlock()
+	}
+
+	select {
+	case <-e.done:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	if e.err != nil {
+		return nil, e.err
+	}
+	return append([]string(nil), e.addrs...), nil
+}
+
+// fill queries host for e; the query is not bound to any single caller's context.
+func (r *Resolver) fill(host string, e *dnsEntry) {
+	defer close(e.done)
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	ttl := r.TTL
+	if ttl <= 0 {
+		ttl = DefaultDNSTTL
+	}
+	if r.DoH != "" {
+		var answerTTL time.Duration
+		e.addrs, answerTTL, e.err = r.lookupDoH(ctx, host)
+		var dnsErr *net.DNSError
+		if e.err != nil && r.Fallback && !(errors.As(e.err, &dnsErr) && dnsErr.IsNotFound) {
+			e.addrs, e.err = net.DefaultResolver.LookupHost(ctx, host)
+		} else if answerTTL < ttl {
+			ttl = answerTTL
+		}
+	} else {
+		e.addrs, e.err = r.netResolver().LookupHost(ctx, host)
+	}
+	if e.err == nil && len(e.addrs) == 0 {
+		e.err = &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+	if e.err != nil {
+		var dnsErr *net.DNSError
+		if !errors.As(e.err, &dnsErr) || !dnsErr.IsNotFound {
+			ttl = 0
+		} else if ttl = r.NegativeTTL; ttl == 0 {
+			ttl = DefaultDNSNegativeTTL
+		}
+	}
+	e.expires = time.Now().Add(ttl)
+}
+
+func (r *Resolver) netResolver() *net.Resolver {
+	r.once.Do(func() {
+		if r.Server == "" {
+			r.resolver = net.DefaultResolver
+			return
+		}
+		server := r.Server
+		if _, _, err := net.SplitHostPort(server); err != nil {
+			server = net.JoinHostPort(server, "53")
+		}
+		r.resolver = &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, network, server)
+			},
+		}
+	})
+	return r.resolver
+}
+
+// prune drops expired entries, the caller holds r.mu.
+func (r *Resolver) prune(now time.Time) {
+	for host, e := range r.cache {
+		select {
+		case <-e.done:
+			if now.After(e.expires) {
+				delete(r.cache, host)
+			}
+		default:
+		}
+	}
+}
+
+// Flush empties the cache.
+func (r *Resolver) Flush() {
+	r.mu.Lock()
+	r.cache = nil
+	r.mu.Unlock()
+}
+
+// mergeHosts returns the static host overrides in effect with lower-cased keys,
+// the request's own entries overriding the engine's.
+func (r *Request) mergeHosts(engine map[string]string) map[string]string {
+	if len(engine) == 0 && len(r.Resolve) == 0 {
+		return nil
+	}
+	hosts := make(map[string]string, len(engine)+len(r.Resolve))
+	for _, m := range []map[string]string{engine, r.Resolve} {
+		for k, v := range m {
+			hosts[strings.ToLower(k)] = v
+		}
+	}
+	return hosts
+}
+
+// hostsKey serializes static host overrides for transportKey.
+func hostsKey(hosts map[string]string) string {
+	keys := make([]string, 0, len(hosts))
+	for k := range hosts {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var b strings.Builder
+	for _, k := range keys {
+		b.WriteString(k)
+		b.WriteByte('=')
+		b.WriteString(hosts[k])
+		b.WriteByte(';')
+	}
+	return b.String()
+}
@@ -0,0 +1,285 @@
+// Copyright 2015 henrylee2cn Author. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package surfer
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// dnsReply answers a DNS query message with the A records in hosts,
+// NXDOMAIN for unknown names and an empty answer for other types.
+func dnsReply(query []byte, hosts map[string]string) []byte {
+	if len(query) < 12 {
+		return nil
+	}
+	var labels []string
+	i := 12
+	for i < len(query) && query[i] != 0 {
+		n := int(query[i])
+		if i+1+n > len(query) {
+			return nil
+		}
+		labels = append(labels, string(query[i+1:i+1+n]))
+		i += 1 + n
+	}
+	end := i + 5
+	if end > len(query) {
+		return nil
+	}
+	qtype := binary.BigEndian.Uint16(query[i+1:])
+	ip, ok := hosts[strings.ToLower(strings.Join(labels, "."))]
+
+	msg := append([]byte(nil), query[:2]...)
+	flags := uint16(0x8180)
+	if !ok {
+		flags |= 3
+	}
+	var answers []byte
+	if ok && qtype == 1 {
+		answers = []byte{0xc0, 12, 0, 1, 0, 1, 0, 0, 0, 60, 0, 4}
+		answers = append(answers, net.ParseIP(ip).To4()...)
+	}
+	msg = binary.BigEndian.AppendUint16(msg, flags)
+	msg = append(msg, 0, 1)
+	if answers != nil {
+		msg = append(msg, 0, 1)
+	} else {
+		msg = append(msg, 0, 0)
+	}
+	msg = append(msg, 0, 0, 0, 0)
+	msg = append(msg, query[12:end]...)
+	return append(msg, answers...)
+}
+
+// serveDNS runs a UDP DNS server answering from hosts and counting the queries.
+func serveDNS(t *testing.T, hosts map[string]string, queries *int32) string {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(queries, 1)
+			if reply := dnsReply(buf[:n], hosts); reply != nil {
+				conn.WriteTo(reply, addr)
+			}
+		}
+	}()
+	return conn.LocalAddr().String()
+}
+
+func TestResolver(t *testing.T) {
+	var queries int32
+	server := serveDNS(t, map[string]string{"origin.test": "127.0.0.1"}, &queries)
+	r := &Resolver{Server: server, TTL: time.Hour, NegativeTTL: time.Hour}
+	ctx := context.Background()
+
+	for i := 0; i < 3; i++ {
+		addrs, err := r.LookupHost(ctx, "Origin.test.")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(addrs) != 1 || addrs[0] != "127.0.0.1" {
+			t.Fatalf("got %v", addrs)
+		}
+	}
+	n := atomic.LoadInt32(&queries)
+	if n == 0 {
+		t.Fatal("the DNS server was not queried")
+	}
+
+	for i := 0; i < 2; i++ {
+		_, err := r.LookupHost(ctx, "missing.test")
+		var dnsErr *net.DNSError
+		if !errors.As(err, &dnsErr) || !dnsErr.IsNotFound {
+			t.Fatalf("expected not found, got %v", err)
+		}
+	}
+	m := atomic.LoadInt32(&queries)
+	if _, err := r.LookupHost(ctx, "origin.test"); err != nil {
+		t.Fatal(err)
+	}
+	r.LookupHost(ctx, "missing.test")
+	if got := atomic.LoadInt32(&queries); got != m {
+		t.Errorf("cached answers were queried again: %d queries, want %d", got, m)
+	}
+
+	r.Flush()
+	r.LookupHost(ctx, "origin.test")
+	if atomic.LoadInt32(&queries) == m {
+		t.Error("Flush did not empty the cache")
+	}
+
+	// a server that never answers must not hold up a caller past its context
+	blackhole, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer blackhole.Close()
+	r = NewResolver(blackhole.LocalAddr().String())
+	timeoutCtx, cancel := context.WithTimeout(ctx, 200*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, err = r.LookupHost(timeoutCtx, "origin.test"); !errors.Is(err, context.DeadlineExceeded) || time.Since(start) > time.Second {
+		t.Errorf("expected the context deadline, got %v after %v", err, time.Since(start))
+	}
+}
+
+func TestResolveOverrides(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Host))
+	}))
+	defer srv.Close()
+	_, port, _ := net.SplitHostPort(srv.Listener.Addr().String())
+
+	var queries int32
+	server := serveDNS(t, map[string]string{"engine.test": "127.0.0.1"}, &queries)
+	s := &Surf{
+		Resolver: NewResolver(server),
+		Resolve:  map[string]string{"pinned.test": "127.0.0.2"},
+	}
+	for _, host := range []string{"pinned.test", "engine.test", "other.test"} {
+		req := &Request{
+			Url:     "http://" + host + ":" + port + "/",
+			Resolve: map[string]string{"Pinned.test:" + port: "127.0.0.1", "other.test": "127.0.0.1"},
+		}
+		resp, err := s.Download(req)
+		if err != nil {
+			t.Fatal(host, err)
+		}
+		b, _ := BodyBytes(resp)
+		if string(b) != host+":"+port {
+			t.Errorf("server saw host %q, want %s:%s", b, host, port)
+		}
+	}
+	if atomic.LoadInt32(&queries) == 0 {
+		t.Error("the engine resolver was not used")
+	}
+}
+
+func TestDoHResolver(t *testing.T) {
+	var queries, rejectAAAA int32
+	var method atomic.Value
+	hosts := map[string]string{"origin.test": "127.0.0.1"}
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&queries, 1)
+		method.Store(r.Method)
+		var query []byte
+		if r.Method == "POST" {
+			if r.Header.Get("Content-Type") != "application/dns-message" {
+				http.Error(w, "bad content type", http.StatusUnsupportedMediaType)
+				return
+			}
+			query, _ = ioutil.ReadAll(r.Body)
+		} else {
+			query, _ = base64.RawURLEncoding.DecodeString(r.URL.Query().Get("dns"))
+		}
+		// the question ends the query: type and class
+		if len(query) > 4 && binary.BigEndian.Uint16(query[len(query)-4:]) == dnsTypeAAAA && atomic.LoadInt32(&rejectAAAA) == 1 {
+			http.Error(w, "IPv4 only", http.StatusNotImplemented)
+			return
+		}
+		reply := dnsReply(query, hosts)
+		if reply == nil {
+			http.Error(w, "bad query", http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/dns-message")
+		w.Write(reply)
+	}))
+	defer srv.Close()
+	ctx := context.Background()
+
+	for _, post := range []bool{false, true} {
+		atomic.StoreInt32(&queries, 0)
+		r := NewDoHResolver(srv.URL + "/dns-query")
+		r.DoHPost = post
+		r.Client = srv.Client()
+		for i := 0; i < 2; i++ {
+			addrs, err := r.LookupHost(ctx, "origin.test")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(addrs) != 1 || addrs[0] != "127.0.0.1" {
+				t.Fatalf("got %v", addrs)
+			}
+		}
+		if want := map[bool]string{false: "GET", true: "POST"}[post]; method.Load() != want {
+			t.Errorf("queries sent with %v, want %s", method.Load(), want)
+		}
+		if n := atomic.LoadInt32(&queries); n != 2 {
+			t.Errorf("%d queries for two lookups, want one A and one AAAA query", n)
+		}
+		_, err := r.LookupHost(ctx, "missing.test")
+		var dnsErr *net.DNSError
+		if !errors.As(err, &dnsErr) || !dnsErr.IsNotFound {
+			t.Errorf("expected not found, got %v", err)
+		}
+	}
+
+	// answers are cached for their own TTL of 60s
+	r := &Resolver{DoH: srv.URL, Client: srv.Client(), TTL: time.Hour}
+	r.LookupHost(ctx, "origin.test")
+	r.mu.Lock()
+	expires := r.cache["origin.test"].expires
+	r.mu.Unlock()
+	if d := time.Until(expires); d > time.Minute || d < 50*time.Second {
+		t.Errorf("answer cached for %v", d)
+	}
+
+	// a failing AAAA query keeps the A answer, unless there is none
+	atomic.StoreInt32(&rejectAAAA, 1)
+	r = &Resolver{DoH: srv.URL, Client: srv.Client()}
+	if addrs, err := r.LookupHost(ctx, "origin.test"); err != nil || len(addrs) != 1 || addrs[0] != "127.0.0.1" {
+		t.Errorf("IPv4-only DoH server: got %v, %v", addrs, err)
+	}
+	if _, err := r.LookupHost(ctx, "missing.test"); err == nil {
+		t.Error("expected an error when no family answered")
+	}
+	atomic.StoreInt32(&rejectAAAA, 0)
+
+	broken := &Resolver{DoH: srv.URL + "/down", Client: &http.Client{Transport: roundTripFunc(func(*http.Request) (*http.Response, error) {
+		return nil, errors.New("unreachable")
+	})}}
+	if _, err := broken.LookupHost(ctx, "localhost"); err == nil {
+		t.Error("expected an error without fallback")
+	}
+	broken.Flush()
+	broken.Fallback = true
+	if addrs, err := broken.LookupHost(ctx, "localhost"); err != nil || len(addrs) == 0 {
+		t.Errorf("fallback failed: %v %v", addrs, err)
+	}
+}
+
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) { return f(req) }
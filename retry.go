@@ -0,0 +1,180 @@
+// Copyright 2015 henrylee2cn Author. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package surfer
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// constant
+const (
+	DefaultMaxVerifyBody = 32 << 20 // 请求未设置MaxBodySize时，VerifyBody最多读入内存的字节数
+)
+
+// RetryPolicy decides after every failed or unwanted download attempt
+// whether to try again, and how long to pause first.
+type RetryPolicy interface {
+	// Retry is called after the attempt-th try (counting from 1) returned resp or err.
+	// When retry is true the engine closes resp.Body and tries again after wait.
+	// Retry is not called for the last of Request.TryTimes attempts.
+	Retry(req *Request, attempt int, resp *http.Response, err error) (retry bool, wait time.Duration)
+}
+
+// RetryPolicyFunc is an adapter to allow the use of ordinary functions as RetryPolicy.
+type RetryPolicyFunc func(req *Request, attempt int, resp *http.Response, err error) (bool, time.Duration)
+
+// Retry calls f(req, attempt, resp, err).
+func (f RetryPolicyFunc) Retry(req *Request, attempt int, resp *http.Response, err error) (bool, time.Duration) {
+	return f(req, attempt, resp, err)
+}
+
+// FixedRetry 仅在网络错误时重试，每次停顿Request.RetryPause，未设置RetryPolicy时使用
+var FixedRetry RetryPolicy = RetryPolicyFunc(func(req *Request, attempt int, resp *http.Response, err error) (bool, time.Duration) {
+	return err != nil, req.RetryPause
+})
+
+// DefaultRetryPolicy retries network errors, 5xx and 429 with exponential backoff,
+// honoring the Retry-After header.
+var DefaultRetryPolicy RetryPolicy = &Backoff{
+	Base:   time.Second,
+	Max:    time.Minute,
+	Jitter: 0.5,
+}
+
+// Backoff is a RetryPolicy with exponential backoff and jitter.
+// Network errors and the status codes accepted by RetryStatus are retried;
+// a Retry-After header on such a response overrides the computed pause.
+type Backoff struct {
+	// Base is the pause before the second attempt, doubled for every further one
+	// (0 means Request.RetryPause)
+	Base time.Duration
+	// Max caps the pause; a longer Retry-After ends the retries (0 means no cap)
+	Max time.Duration
+	// Jitter randomizes up to this fraction (0~1) of every pause
+	Jitter float64
+	// RetryStatus reports whether a status code is worth retrying (nil means RetryableStatus)
+	RetryStatus func(code int) bool
+	// VerifyBody reads the whole body within the attempt so a truncated body
+	// is retried as well; the response is then returned with a buffered body.
+	// At most Request.MaxBodySize (or DefaultMaxVerifyBody) bytes are buffered,
+	// a longer body is returned unverified
+	VerifyBody bool
+}
+
+var _ RetryPolicy = new(Backoff)
+
+// Retry implements RetryPolicy.
+func (b *Backoff) Retry(req *Request, attempt int, resp *http.Response, err error) (bool, time.Duration) {
+	if err == nil {
+		retryStatus := b.RetryStatus
+		if retryStatus == nil {
+			retryStatus = RetryableStatus
+		}
+		if retryStatus(resp.StatusCode) {
+			if d, ok := RetryAfter(resp); ok {
+				if b.Max > 0 && d > b.Max {
+					return false, 0
+				}
+				return true, d
+			}
+		} else if !b.VerifyBody || verifyBody(resp, req.MaxBodySize) == nil {
+			return false, 0
+		}
+	}
+
+	base := b.Base
+	if base <= 0 {
+		base = req.RetryPause
+	}
+	d := base
+	for i := 1; i < attempt && (b.Max <= 0 || d < b.Max); i++ {
+		d *= 2
+	}
+	if b.Max > 0 && d > b.Max {
+		d = b.Max
+	}
+	if b.Jitter > 0 && d > 0 {
+		j := time.Duration(float64(d) * b.Jitter)
+		if j > 0 {
+			d = d - j + time.Duration(rand.Int63n(int64(j)+1))
+		}
+	}
+	return true, d
+}
+
+// RetryableStatus reports whether code is 429 or a 5xx other than 501 Not Implemented.
+func RetryableStatus(code int) bool {
+	return code == http.StatusTooManyRequests ||
+		code >= http.StatusInternalServerError && code != http.StatusNotImplemented
+}
+
+// RetryAfter parses the Retry-After header of resp, in delay-seconds or HTTP-date form.
+func RetryAfter(resp *http.Response) (time.Duration, bool) {
+	if resp == nil {
+		return 0, false
+	}
+	v := strings.TrimSpace(resp.Header.Get("Retry-After"))
+	if v == "" {
+		return 0, false
+	}
+	if secs, err := strconv.Atoi(v); err == nil {
+		if secs < 0 {
+			secs = 0
+		}
+		return time.Duration(secs) * time.Second, true
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		d := time.Until(t)
+		if d < 0 {
+			d = 0
+		}
+		return d, true
+	}
+	return 0, false
+}
+
+// verifyBody reads resp.Body into memory and replaces it with the buffered copy.
+// A body longer than limit (0 means DefaultMaxVerifyBody) is not read to the end:
+// the buffered part is put in front of the rest and nil is returned.
+func verifyBody(resp *http.Response, limit int64) error {
+	if limit <= 0 {
+		limit = DefaultMaxVerifyBody
+	}
+	b, err := ioutil.ReadAll(io.LimitReader(resp.Body, limit+1))
+	if err == nil && int64(len(b)) > limit {
+		resp.Body = &RespBody{ReadCloser: resp.Body, Reader: io.MultiReader(bytes.NewReader(b), resp.Body)}
+		return nil
+	}
+	resp.Body.Close()
+	resp.Body = ioutil.NopCloser(bytes.NewReader(b))
+	return err
+}
+
+// discardResponse drains a little of the body of an abandoned attempt
+// so its connection can be reused, then closes it.
+func discardResponse(resp *http.Response) {
+	if resp == nil || resp.Body == nil {
+		return
+	}
+	io.CopyN(ioutil.Discard, resp.Body, 4<<10)
+	resp.Body.Close()
+}
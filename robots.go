@@ -0,0 +1,465 @@
+// Copyright 2015 henrylee2cn Author. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package surfer
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// constant
+const (
+	DefaultRobotsTTL      = 24 * time.Hour // 默认robots.txt缓存时长
+	DefaultRobotsErrorTTL = time.Minute    // 默认robots.txt获取失败(5xx/网络错误)时的缓存时长
+	maxRobotsSize         = 500 << 10      // RFC 9309 要求至少解析的字节数
+)
+
+// RobotsError is returned when robots.txt disallows a request.
+type RobotsError struct {
+	URL       string
+	UserAgent string
+}
+
+func (e *RobotsError) Error() string {
+	return fmt.Sprintf("surfer: %s is disallowed by robots.txt for %q", e.URL, e.UserAgent)
+}
+
+// Is reports whether target is ErrRobotsDisallowed.
+func (e *RobotsError) Is(target error) bool {
+	return target == ErrRobotsDisallowed
+}
+
+// Robots is an opt-in robots.txt policy for the Surf engine.
+// It fetches /robots.txt once per scheme+host, caches it, rejects disallowed
+// requests and redirects with *RobotsError and passes Crawl-delay to the request's
+// Limiter; requests without a Limiter are spaced by Crawl-delay per host all the same.
+type Robots struct {
+	// UserAgent is the product token matched against the User-agent lines, e.g. "mybot";
+	// empty means the product token of the request's User-Agent header, e.g. "Mozilla"
+	UserAgent string
+	// TTL is how long a fetched robots.txt is cached, 0 means DefaultRobotsTTL
+	TTL time.Duration
+	// ErrorTTL is how long a failed fetch is cached, 0 means DefaultRobotsErrorTTL
+	ErrorTTL time.Duration
+
+	mu    sync.Mutex
+	cache map[string]*robotsEntry
+	// delays applies Crawl-delay to requests without a Limiter
+	delays Limiter
+}
+
+type robotsEntry struct {
+	ready   chan struct{}
+	data    *RobotsData
+	expires time.Time
+}
+
+// check returns a *RobotsError when robots.txt disallows param, and applies
+// its Crawl-delay to limiter, or waits for it itself when limiter is nil.
+func (rb *Robots) check(ctx context.Context, surf *Surf, param *Request, limiter *Limiter) error {
+	u := param.url
+	data, ua, err := rb.allowed(ctx, surf, param, u)
+	if err != nil || data == nil {
+		return err
+	}
+	d, ok := data.CrawlDelay(ua)
+	if !ok {
+		return nil
+	}
+	if limiter != nil {
+		limiter.crawlDelay(limiter.key(u), d)
+		return nil
+	}
+	rb.delays.crawlDelay(rb.delays.key(u), d)
+	release, err := rb.delays.Wait(ctx, u)
+	if err != nil {
+		return param.contextError(err)
+	}
+	release()
+	return nil
+}
+
+// checkRedirect returns a *RobotsError when robots.txt disallows the redirect to u.
+func (rb *Robots) checkRedirect(ctx context.Context, surf *Surf, param *Request, u *url.URL) error {
+	_, _, err := rb.allowed(ctx, surf, param, u)
+	return err
+}
+
+// allowed returns a *RobotsError when robots.txt disallows u, or else the
+// robots.txt of u and the user agent it was matched with; data is nil for /robots.txt itself.
+func (rb *Robots) allowed(ctx context.Context, surf *Surf, param *Request, u *url.URL) (data *RobotsData, ua string, err error) {
+	if u.EscapedPath() == "/robots.txt" {
+		return nil, "", nil
+	}
+	if data, err = rb.get(ctx, surf, param, u); err != nil {
+		return nil, "", err
+	}
+	ua = rb.UserAgent
+	if ua == "" {
+		ua = param.Header.Get("User-Agent")
+	}
+	if !data.Allowed(ua, robotsPath(u)) {
+		return nil, "", &RobotsError{URL: u.String(), UserAgent: ua}
+	}
+	return data, ua, nil
+}
+
+// get returns the cached robots.txt of u's scheme+host, fetching it at most once at a time.
+func (rb *Robots) get(ctx context.Context, surf *Surf, param *Request, u *url.URL) (*RobotsData, error) {
+	key := strings.ToLower(u.Scheme + "://" + u.Host)
+	for {
+		rb.mu.Lock()
+		e, ok := rb.cache[key]
+		if ok {
+			rb.mu.Unlock()
+			select {
+			case <-e.ready:
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+			if e.data != nil && time.Now().Before(e.expires) {
+				return e.data, nil
+			}
+			rb.mu.Lock()
+			if rb.cache[key] == e {
+				delete(rb.cache, key)
+			}
+			rb.mu.Unlock()
+			continue
+		}
+		e = &robotsEntry{ready: make(chan struct{})}
+		if rb.cache == nil {
+			rb.cache = make(map[string]*robotsEntry)
+		}
+		rb.cache[key] = e
+		rb.mu.Unlock()
+
+		data, ttl, err := rb.fetch(ctx, surf, param, key+"/robots.txt")
+		if err == nil {
+			e.data, e.expires = data, time.Now().Add(ttl)
+		}
+		close(e.ready)
+		if err != nil {
+			return nil, err
+		}
+		return data, nil
+	}
+}
+
+// valuelessContext is the cancellation of a context without its values.
+type valuelessContext struct {
+	context.Context
+}
+
+func (valuelessContext) Value(interface{}) interface{} { return nil }
+
+// fetch downloads and parses robotsURL following RFC 9309:
+// 4xx means everything is allowed, 5xx and network errors mean nothing is.
+func (rb *Robots) fetch(ctx context.Context, surf *Surf, param *Request, robotsURL string) (*RobotsData, time.Duration, error) {
+	ttl, errTTL := rb.TTL, rb.ErrorTTL
+	if ttl <= 0 {
+		ttl = DefaultRobotsTTL
+	}
+	if errTTL <= 0 {
+		errTTL = DefaultRobotsErrorTTL
+	}
+
+	fetchReq := &Request{
+		Url:                   robotsURL,
+		DialTimeout:           param.DialTimeout,
+		ConnTimeout:           param.ConnTimeout,
+		TLSHandshakeTimeout:   param.TLSHandshakeTimeout,
+		ResponseHeaderTimeout: param.ResponseHeaderTimeout,
+		TLS:                   param.tlsConfig(surf.TLS),
+		Resolve:               param.Resolve,
+		LocalAddrs:            param.LocalAddrs,
+		AddressFamily:         param.AddressFamily,
+	}
+	if err := fetchReq.prepare(); err != nil {
+		return nil, 0, err
+	}
+	fetchReq.proxy = param.proxy
+	fetchReq.Header.Set("User-Agent", param.Header.Get("User-Agent"))
+	transport, err := surf.transport(fetchReq)
+	if err != nil {
+		return nil, 0, err
+	}
+	client := &http.Client{
+		Timeout:   fetchReq.ConnTimeout,
+		Transport: transport,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= 5 {
+				return fmt.Errorf("stopped after 5 redirects: %w", ErrRedirectLimit)
+			}
+			return nil
+		},
+	}
+	if surf.Cache != nil {
+		// robots.txt is cached like any page, e.g. for ForceCache runs offline
+		client.Transport = &cacheTransport{cache: surf.Cache, transport: transport}
+	}
+	req, err := fetchReq.newHTTPRequest(ctx)
+	if err != nil {
+		return nil, 0, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, 0, err
+		}
+		return disallowAllRobots, errTTL, nil
+	}
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		data, err := ParseRobots(resp.Body)
+		if err != nil {
+			return disallowAllRobots, errTTL, nil
+		}
+		return data, ttl, nil
+	case resp.StatusCode >= 400 && resp.StatusCode < 500:
+		return allowAllRobots, ttl, nil
+	default:
+		return disallowAllRobots, errTTL, nil
+	}
+}
+
+// robotsPath returns the path and query of u as matched against robots.txt rules.
+func robotsPath(u *url.URL) string {
+	p := u.EscapedPath()
+	if p == "" {
+		p = "/"
+	}
+	if u.RawQuery != "" {
+		p += "?" + u.RawQuery
+	}
+	return p
+}
+
+// RobotsData is a parsed robots.txt, see RFC 9309.
+type RobotsData struct {
+	// Sitemaps lists the Sitemap URLs of the file
+	Sitemaps    []string
+	groups      []*robotsGroup
+	disallowAll bool
+}
+
+type robotsGroup struct {
+	agents     []string
+	rules      []robotsRule
+	crawlDelay time.Duration
+	hasDelay   bool
+}
+
+type robotsRule struct {
+	allow   bool
+	pattern string
+}
+
+var (
+	allowAllRobots    = &RobotsData{}
+	disallowAllRobots = &RobotsData{disallowAll: true}
+)
+
+// ParseRobots parses a robots.txt file.
+// Only the first 500 KiB are read, as RFC 9309 allows.
+func ParseRobots(r io.Reader) (*RobotsData, error) {
+	data := new(RobotsData)
+	var group *robotsGroup
+	inAgents := false
+
+	scanner := bufio.NewScanner(io.LimitReader(r, maxRobotsSize))
+	scanner.Buffer(make([]byte, 0, 4096), maxRobotsSize)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		i := strings.IndexByte(line, ':')
+		if i < 0 {
+			continue
+		}
+		key := strings.ToLower(strings.TrimSpace(line[:i]))
+		value := strings.TrimSpace(line[i+1:])
+
+		switch key {
+		case "user-agent":
+			if !inAgents {
+				group = new(robotsGroup)
+				data.groups = append(data.groups, group)
+				inAgents = true
+			}
+			group.agents = append(group.agents, robotsProductToken(value))
+			continue
+		case "allow", "disallow":
+			if group != nil && value != "" {
+				group.rules = append(group.rules, robotsRule{
+					allow:   key == "allow",
+					pattern: normalizeRobotsPattern(value),
+				})
+			}
+		case "crawl-delay":
+			if group != nil {
+				if secs, err := strconv.ParseFloat(value, 64); err == nil && secs >= 0 {
+					group.crawlDelay = time.Duration(secs * float64(time.Second))
+					group.hasDelay = true
+				}
+			}
+		case "sitemap":
+			data.Sitemaps = append(data.Sitemaps, value)
+			continue
+		}
+		inAgents = false
+	}
+	return data, scanner.Err()
+}
+
+// Allowed reports whether userAgent may fetch path (with query), which should be escaped.
+// userAgent is a product token or a User-Agent header, whose product token is used.
+func (d *RobotsData) Allowed(userAgent, path string) bool {
+	if d.disallowAll {
+		return false
+	}
+	if path == "/robots.txt" {
+		return true
+	}
+	path = normalizeRobotsPattern(path)
+	best, allow := -1, true
+	for _, g := range d.match(userAgent) {
+		for _, rule := range g.rules {
+			if len(rule.pattern) < best || !robotsMatch(rule.pattern, path) {
+				continue
+			}
+			if len(rule.pattern) > best {
+				best, allow = len(rule.pattern), rule.allow
+			} else if rule.allow {
+				allow = true
+			}
+		}
+	}
+	return allow
+}
+
+// CrawlDelay returns the Crawl-delay of the group that applies to userAgent, see Allowed.
+func (d *RobotsData) CrawlDelay(userAgent string) (time.Duration, bool) {
+	for _, g := range d.match(userAgent) {
+		if g.hasDelay {
+			return g.crawlDelay, true
+		}
+	}
+	return 0, false
+}
+
+// match returns the groups that apply to userAgent: those naming its product
+// token, compared case-insensitively as RFC 9309 requires, or else the "*" groups.
+func (d *RobotsData) match(userAgent string) []*robotsGroup {
+	token := robotsProductToken(userAgent)
+	var groups, wildcard []*robotsGroup
+	for _, g := range d.groups {
+		matched, isWildcard := false, false
+		for _, agent := range g.agents {
+			if agent == "*" {
+				isWildcard = true
+			} else if agent != "" && strings.EqualFold(agent, token) {
+				matched = true
+			}
+		}
+		switch {
+		case matched:
+			groups = append(groups, g)
+		case isWildcard:
+			wildcard = append(wildcard, g)
+		}
+	}
+	if len(groups) > 0 {
+		return groups
+	}
+	return wildcard
+}
+
+// robotsMatch reports whether path matches pattern, where "*" matches any
+// sequence of characters and a trailing "$" anchors the end of the path.
+func robotsMatch(pattern, path string) bool {
+	anchored := strings.HasSuffix(pattern, "$")
+	if anchored {
+		pattern = pattern[:len(pattern)-1]
+	}
+	parts := strings.Split(pattern, "*")
+	if !strings.HasPrefix(path, parts[0]) {
+		return false
+	}
+	rest := path[len(parts[0]):]
+	if len(parts) == 1 {
+		return !anchored || rest == ""
+	}
+	for i, part := range parts[1:] {
+		if anchored && i == len(parts)-2 {
+			return strings.HasSuffix(rest, part)
+		}
+		j := strings.Index(rest, part)
+		if j < 0 {
+			return false
+		}
+		rest = rest[j+len(part):]
+	}
+	return true
+}
+
+// normalizeRobotsPattern percent-encodes the non-ASCII octets of a rule
+// and upper-cases existing escapes, so it compares with escaped paths.
+func normalizeRobotsPattern(p string) string {
+	var b strings.Builder
+	for i := 0; i < len(p); i++ {
+		c := p[i]
+		switch {
+		case c == '%' && i+2 < len(p) && isHex(p[i+1]) && isHex(p[i+2]):
+			b.WriteByte('%')
+			b.WriteString(strings.ToUpper(p[i+1 : i+3]))
+			i += 2
+		case c >= 0x80 || c == ' ':
+			fmt.Fprintf(&b, "%%%02X", c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// robotsProductToken returns the lower-cased product token of a user-agent line
+// or User-Agent header, e.g. "googlebot" for "Googlebot/2.1".
+func robotsProductToken(value string) string {
+	value = strings.ToLower(strings.TrimSpace(value))
+	if value == "*" {
+		return value
+	}
+	for i := 0; i < len(value); i++ {
+		if c := value[i]; !('a' <= c && c <= 'z' || c == '_' || c == '-') {
+			return value[:i]
+		}
+	}
+	return value
+}
+
+func isHex(c byte) bool {
+	return '0' <= c && c <= '9' || 'a' <= c && c <= 'f' || 'A' <= c && c <= 'F'
+}
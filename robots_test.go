@@ -0,0 +1,161 @@
+// Copyright 2015 henrylee2cn Author. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package surfer
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const testRobots = `
+# comment
+User-agent: *
+Disallow: /private
+Allow: /private/public
+Disallow: /*.pdf$
+Crawl-delay: 1.5
+
+User-agent: ExampleBot/1.0
+User-agent: otherbot
+Disallow: /
+Allow: /page$
+
+User-agent: Go
+Disallow: /
+
+Sitemap: https://example.com/sitemap.xml
+`
+
+func TestParseRobots(t *testing.T) {
+	data, err := ParseRobots(strings.NewReader(testRobots))
+	if err != nil {
+		t.Fatal(err)
+	}
+	browser := "Mozilla/5.0 (Windows NT 6.3; x64) Chrome/37.0.2049.0 Safari/537.36"
+	cases := []struct {
+		ua, path string
+		allowed  bool
+	}{
+		{browser, "/", true},
+		{browser, "/private", false},
+		{browser, "/private/x", false},
+		{browser, "/private/public/x", true},
+		{browser, "/doc.pdf", false},
+		{browser, "/doc.pdf?x=1", true},
+		{browser, "/robots.txt", true},
+		{"examplebot/2.0", "/anything", false},
+		{"Mozilla/5.0 (compatible; ExampleBot/1.0)", "/anything", true},
+		{"ExampleBot", "/page/2", false},
+		{"OtherBot", "/private/public", false},
+		// only the product token is matched, case-insensitively
+		{"Mozilla/5.0 (compatible; Googlebot/2.1)", "/", true},
+		{"GO/1.1", "/", false},
+		{"Go-http-client/1.1", "/", true},
+	}
+	for _, c := range cases {
+		if got := data.Allowed(c.ua, c.path); got != c.allowed {
+			t.Errorf("Allowed(%q, %q) = %v, want %v", c.ua, c.path, got, c.allowed)
+		}
+	}
+	if d, ok := data.CrawlDelay(browser); !ok || d != 1500*time.Millisecond {
+		t.Errorf("unexpected crawl delay %v %v", d, ok)
+	}
+	if _, ok := data.CrawlDelay("examplebot"); ok {
+		t.Error("examplebot group has no crawl delay")
+	}
+	if len(data.Sitemaps) != 1 {
+		t.Errorf("unexpected sitemaps %v", data.Sitemaps)
+	}
+}
+
+func TestSurfRobots(t *testing.T) {
+	var redirects int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/robots.txt":
+			w.Write([]byte(testRobots))
+			return
+		case "/redirect":
+			atomic.AddInt32(&redirects, 1)
+			http.Redirect(w, r, "/private", http.StatusFound)
+			return
+		}
+		w.Write([]byte("ok"))
+	}))
+	defer srv.Close()
+
+	limiter := new(Limiter)
+	s := New().(*Surf)
+	s.Robots = new(Robots)
+	s.Limiter = limiter
+
+	resp, err := s.Download(&Request{Url: srv.URL + "/index"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	_, err = s.Download(&Request{Url: srv.URL + "/private"})
+	var re *RobotsError
+	if !errors.As(err, &re) {
+		t.Fatalf("expected *RobotsError, got %v", err)
+	}
+	if h := limiter.hosts[HostKey(resp.Request.URL)]; h == nil || h.delay != 1500*time.Millisecond {
+		t.Fatalf("crawl delay not applied to limiter: %+v", h)
+	}
+
+	// a disallowed path is not reached through a redirect either, nor retried
+	atomic.StoreInt32(&redirects, 0)
+	_, err = s.Download(&Request{Url: srv.URL + "/redirect", TryTimes: 3})
+	if !errors.As(err, &re) || !strings.HasSuffix(re.URL, "/private") || atomic.LoadInt32(&redirects) != 1 {
+		t.Fatalf("expected one *RobotsError for the redirect target, got %v after %d redirects", err, redirects)
+	}
+
+	// a configured product token picks its own group
+	s.Robots.UserAgent = "ExampleBot"
+	if _, err = s.Download(&Request{Url: srv.URL + "/index"}); !errors.As(err, &re) || re.UserAgent != "ExampleBot" {
+		t.Fatalf("expected the ExampleBot group to disallow /index, got %v", err)
+	}
+}
+
+func TestRobotsCrawlDelay(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/robots.txt" {
+			w.Write([]byte("User-agent: *\nCrawl-delay: 0.2\n"))
+			return
+		}
+		w.Write([]byte("ok"))
+	}))
+	defer srv.Close()
+
+	s := New().(*Surf)
+	s.Robots = new(Robots)
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		resp, err := s.Download(&Request{Url: srv.URL + "/page"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+	if d := time.Since(start); d < 400*time.Millisecond {
+		t.Errorf("Crawl-delay not applied without a Limiter: 3 requests took %v", d)
+	}
+}
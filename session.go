@@ -0,0 +1,123 @@
+// Copyright 2015 henrylee2cn Author. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package surfer
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"net/http"
+	"sync"
+)
+
+// ErrSessionClosed is returned for requests of a closed Session.
+var ErrSessionClosed = errors.New("surfer: session closed")
+
+// Session is an isolated browsing identity with its own cookie jar,
+// a sticky User-Agent, default headers and an optional proxy.
+// Requests bound to different sessions never share cookies, so the same site
+// can be used with several accounts at once. A Session is safe for concurrent use;
+// its exported fields should be set before its first request.
+type Session struct {
+	// UserAgent is sent by requests without a User-Agent header
+	UserAgent string
+	// Header holds default headers, added to requests that do not set them
+	Header http.Header
+	// Proxy is used by requests without their own Proxy
+	Proxy string
+
+	mu     sync.RWMutex
+	jar    *Jar
+	closed bool
+}
+
+// NewSession creates a Session with an empty cookie jar and a random common User-Agent.
+func NewSession() *Session {
+	common := UserAgents["common"]
+	return &Session{
+		UserAgent: common[rand.Intn(len(common))],
+		Header:    make(http.Header),
+		jar:       NewJar(),
+	}
+}
+
+// NewRequest returns a GET request for urlStr bound to the session.
+func (s *Session) NewRequest(urlStr string) *Request {
+	return &Request{Url: urlStr, Session: s}
+}
+
+// Download downloads req within the session.
+func (s *Session) Download(req *Request) (*http.Response, error) {
+	return s.DownloadContext(context.Background(), req)
+}
+
+// DownloadContext downloads req within the session, see DownloadContext.
+func (s *Session) DownloadContext(ctx context.Context, req *Request) (*http.Response, error) {
+	req.Session = s
+	return DownloadContext(ctx, req)
+}
+
+// Clone returns a new Session with copies of the cookies, headers, User-Agent and proxy.
+// The two sessions evolve independently afterwards.
+func (s *Session) Clone() *Session {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return &Session{
+		UserAgent: s.UserAgent,
+		Header:    s.Header.Clone(),
+		Proxy:     s.Proxy,
+		jar:       s.jar.Clone(),
+		closed:    s.closed,
+	}
+}
+
+// Close discards the cookies of the session; later requests fail with ErrSessionClosed.
+func (s *Session) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	s.jar = NewJar()
+	return nil
+}
+
+// Jar returns the cookie jar of the session, e.g. to save or load its cookies.
+func (s *Session) Jar() *Jar {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.jar
+}
+
+// apply fills in the session defaults of r; it is called by Request.prepare
+// on the copy a download works on, see Request.clone.
+func (s *Session) apply(r *Request) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.closed {
+		return ErrSessionClosed
+	}
+	r.EnableCookie = true
+	for k, v := range s.Header {
+		if _, ok := r.Header[k]; !ok {
+			r.Header[k] = append([]string(nil), v...)
+		}
+	}
+	if len(r.Header["User-Agent"]) == 0 && s.UserAgent != "" {
+		r.Header.Set("User-Agent", s.UserAgent)
+	}
+	if r.Proxy == "" {
+		r.Proxy = s.Proxy
+	}
+	return nil
+}
@@ -0,0 +1,243 @@
+// Copyright 2015 henrylee2cn Author. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package surfer
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// parseProxy parses a proxy URL; a URL without scheme means http.
+// Supported schemes are http, https, socks5 and socks5h.
+func parseProxy(proxy string) (*url.URL, error) {
+	proxy = strings.TrimSpace(proxy)
+	if !strings.Contains(proxy, "://") {
+		proxy = "http://" + proxy
+	}
+	u, err := url.Parse(proxy)
+	if err != nil {
+		return nil, err
+	}
+	u.Scheme = strings.ToLower(u.Scheme)
+	switch u.Scheme {
+	case "http", "https", "socks5", "socks5h":
+	default:
+		return nil, fmt.Errorf("surfer: unsupported proxy scheme %q", u.Scheme)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("surfer: invalid proxy %q", proxy)
+	}
+	return u, nil
+}
+
+// setProxy routes t through proxy. SOCKS5 proxies are dialed by surfer itself
+// on top of d; HTTP(S) proxies are left to net/http, which sends the URL's
+// credentials as Proxy-Authorization, CONNECT requests included.
+func setProxy(t *http.Transport, proxy *url.URL, d *hostDialer) {
+	switch proxy.Scheme {
+	case "socks5", "socks5h":
+		t.DialContext = (&socksDialer{
+			proxy:     proxy,
+			remoteDNS: proxy.Scheme == "socks5h",
+			dialer:    d,
+		}).DialContext
+	default:
+		t.Proxy = http.ProxyURL(proxy)
+	}
+}
+
+// socksDialer dials through a SOCKS5 proxy (RFC 1928), authenticating with
+// the username and password of the proxy URL (RFC 1929) when present.
+type socksDialer struct {
+	proxy *url.URL
+	// remoteDNS lets the proxy resolve host names (socks5h), otherwise they are resolved locally
+	remoteDNS bool
+	dialer    *hostDialer
+}
+
+// SOCKS5 protocol constants
+const (
+	socksVersion      = 5
+	socksNoAuth       = 0
+	socksUserPassAuth = 2
+	socksNoAcceptable = 0xff
+	socksConnect      = 1
+	socksIPv4         = 1
+	socksDomain       = 3
+	socksIPv6         = 4
+)
+
+var socksReplies = []string{
+	1: "general SOCKS server failure",
+	2: "connection not allowed by ruleset",
+	3: "network unreachable",
+	4: "host unreachable",
+	5: "connection refused",
+	6: "TTL expired",
+	7: "command not supported",
+	8: "address type not supported",
+}
+
+// DialContext connects to addr through the proxy.
+func (d *socksDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil || port < 1 || port > 0xffff {
+		return nil, fmt.Errorf("socks5: invalid port in %q", addr)
+	}
+	addrs, err := d.dialer.lookup(ctx, host, portStr, d.remoteDNS)
+	if err != nil {
+		return nil, &net.OpError{Op: "dial", Net: network, Err: err}
+	}
+	host = addrs[0]
+
+	proxyAddr := d.proxy.Host
+	if d.proxy.Port() == "" {
+		proxyAddr = net.JoinHostPort(d.proxy.Hostname(), "1080")
+	}
+	conn, err := d.dialer.DialContext(ctx, "tcp", proxyAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	// abort the handshake as soon as ctx is done
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	stop := context.AfterFunc(ctx, func() { conn.SetDeadline(time.Unix(1, 0)) })
+	err = d.handshake(conn, host, port)
+	if !stop() || ctx.Err() != nil {
+		conn.Close()
+		return nil, ctx.Err()
+	}
+	if err != nil {
+		conn.Close()
+		return nil, &net.OpError{Op: "socks5", Net: network, Addr: &proxyAddrInfo{proxyAddr}, Err: err}
+	}
+	conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+func (d *socksDialer) handshake(conn net.Conn, host string, port int) error {
+	methods := []byte{socksNoAuth}
+	if d.proxy.User != nil {
+		methods = append(methods, socksUserPassAuth)
+	}
+	if _, err := conn.Write(append([]byte{socksVersion, byte(len(methods))}, methods...)); err != nil {
+		return err
+	}
+	var buf [4]byte
+	if _, err := io.ReadFull(conn, buf[:2]); err != nil {
+		return err
+	}
+	if buf[0] != socksVersion {
+		return fmt.Errorf("unexpected protocol version %d", buf[0])
+	}
+	switch buf[1] {
+	case socksNoAuth:
+	case socksUserPassAuth:
+		if d.proxy.User == nil {
+			return errors.New("proxy requires authentication")
+		}
+		user := d.proxy.User.Username()
+		pass, _ := d.proxy.User.Password()
+		if len(user) > 255 || len(pass) > 255 {
+			return errors.New("username or password too long")
+		}
+		req := []byte{1, byte(len(user))}
+		req = append(req, user...)
+		req = append(req, byte(len(pass)))
+		req = append(req, pass...)
+		if _, err := conn.Write(req); err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(conn, buf[:2]); err != nil {
+			return err
+		}
+		if buf[1] != 0 {
+			return errors.New("username/password authentication failed")
+		}
+	case socksNoAcceptable:
+		return errors.New("no acceptable authentication methods")
+	default:
+		return fmt.Errorf("unsupported authentication method %d", buf[1])
+	}
+
+	req := []byte{socksVersion, socksConnect, 0}
+	if ip := net.ParseIP(host); ip != nil {
+		if ip4 := ip.To4(); ip4 != nil {
+			req = append(req, socksIPv4)
+			req = append(req, ip4...)
+		} else {
+			req = append(req, socksIPv6)
+			req = append(req, ip.To16()...)
+		}
+	} else {
+		if len(host) > 255 {
+			return errors.New("host name too long")
+		}
+		req = append(req, socksDomain, byte(len(host)))
+		req = append(req, host...)
+	}
+	req = binary.BigEndian.AppendUint16(req, uint16(port))
+	if _, err := conn.Write(req); err != nil {
+		return err
+	}
+
+	if _, err := io.ReadFull(conn, buf[:4]); err != nil {
+		return err
+	}
+	if buf[1] != 0 {
+		if int(buf[1]) < len(socksReplies) {
+			return errors.New(socksReplies[buf[1]])
+		}
+		return fmt.Errorf("unknown reply code %d", buf[1])
+	}
+	var skip int
+	switch buf[3] {
+	case socksIPv4:
+		skip = net.IPv4len
+	case socksIPv6:
+		skip = net.IPv6len
+	case socksDomain:
+		if _, err := io.ReadFull(conn, buf[:1]); err != nil {
+			return err
+		}
+		skip = int(buf[0])
+	default:
+		return fmt.Errorf("unknown address type %d", buf[3])
+	}
+	_, err := io.CopyN(ioutil.Discard, conn, int64(skip)+2)
+	return err
+}
+
+// proxyAddrInfo is the net.Addr of a proxy in dial errors.
+type proxyAddrInfo struct{ addr string }
+
+func (a *proxyAddrInfo) Network() string { return "tcp" }
+func (a *proxyAddrInfo) String() string  { return a.addr }
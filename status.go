@@ -0,0 +1,92 @@
+// Copyright 2015 henrylee2cn Author. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package surfer
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+)
+
+// constant
+const MaxStatusErrorBody = 4 << 10 // StatusError保留的响应体最大字节数
+
+// StatusError is returned for a response whose status code is not accepted,
+// see Request.AcceptStatus. errors.Is matches it with ErrStatus.
+type StatusError struct {
+	URL        string
+	StatusCode int
+	Status     string
+	Header     http.Header
+	// Body holds up to MaxStatusErrorBody bytes of the response body
+	Body []byte
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("surfer: %s returned status %s", e.URL, e.Status)
+}
+
+// Is reports whether target is ErrStatus.
+func (e *StatusError) Is(target error) bool {
+	return target == ErrStatus
+}
+
+// Status2xx accepts the 2xx status codes.
+func Status2xx(statusCode int) bool {
+	return statusCode >= 200 && statusCode < 300
+}
+
+// StatusIn returns an AcceptStatus func accepting the given status codes.
+func StatusIn(codes ...int) func(statusCode int) bool {
+	set := make(map[int]bool, len(codes))
+	for _, c := range codes {
+		set[c] = true
+	}
+	return func(statusCode int) bool {
+		return set[statusCode]
+	}
+}
+
+// acceptStatus returns the AcceptStatus in effect, the request's own one overriding the engine's.
+func (r *Request) acceptStatus(engine func(int) bool) func(int) bool {
+	if r.AcceptStatus != nil {
+		return r.AcceptStatus
+	}
+	return engine
+}
+
+// checkStatus returns a *StatusError when accept rejects the status code of resp.
+// The body is then read up to MaxStatusErrorBody and replaced by that snippet.
+func (r *Request) checkStatus(resp *http.Response, accept func(int) bool) error {
+	if accept == nil || accept(resp.StatusCode) {
+		return nil
+	}
+	snippet, _ := ioutil.ReadAll(io.LimitReader(resp.Body, MaxStatusErrorBody))
+	resp.Body.Close()
+	resp.Body = ioutil.NopCloser(bytes.NewReader(snippet))
+	status := resp.Status
+	if status == "" {
+		status = fmt.Sprintf("%d %s", resp.StatusCode, http.StatusText(resp.StatusCode))
+	}
+	return &StatusError{
+		URL:        r.Url,
+		StatusCode: resp.StatusCode,
+		Status:     status,
+		Header:     resp.Header,
+		Body:       snippet,
+	}
+}
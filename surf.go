@@ -18,36 +18,97 @@ import (
 	"compress/flate"
 	"compress/gzip"
 	"compress/zlib"
-	"crypto/tls"
+	"context"
+	"errors"
+	"fmt"
 	"io"
 	"math/rand"
-	"net"
 	"net/http"
-	"net/http/cookiejar"
-	"strings"
+	"net/http/httptrace"
+	"sync"
 	"time"
 )
 
 // Surf is the default Download implementation.
+// Connections are pooled per proxy/TLS/timeout settings and reused across downloads;
+// the exported fields should be set before the first download.
 type Surf struct {
-	cookieJar *cookiejar.Jar
+	// MaxIdleConns limits the idle connections kept by each transport (0 means DefaultMaxIdleConns)
+	MaxIdleConns int
+	// MaxIdleConnsPerHost limits the idle connections kept per host (0 means DefaultMaxIdleConnsPerHost)
+	MaxIdleConnsPerHost int
+	// MaxConnsPerHost limits the total connections per host, 0 means no limit
+	MaxConnsPerHost int
+	// IdleConnTimeout is how long an idle connection is kept (0 means DefaultIdleConnTimeout)
+	IdleConnTimeout time.Duration
+	// RetryPolicy is used for requests without their own RetryPolicy (nil means FixedRetry)
+	RetryPolicy RetryPolicy
+	// Limiter throttles requests without their own Limiter, nil means no limit
+	Limiter *Limiter
+	// Robots enforces robots.txt when set
+	Robots *Robots
+	// Cache serves and stores responses when set
+	Cache *Cache
+	// ProxyPool provides the proxy of every attempt of requests without their own Proxy
+	ProxyPool *ProxyPool
+	// TLS configures HTTPS for requests without their own TLS, nil skips certificate verification
+	TLS *TLSConfig
+	// HTTPVersion is used by requests with HTTPAuto
+	HTTPVersion HTTPVersion
+	// Resolver caches DNS lookups, nil uses the system resolver without caching
+	Resolver *Resolver
+	// Resolve maps "host:port" or "host" to an IP address like curl --resolve,
+	// requests add their own Request.Resolve entries
+	Resolve map[string]string
+	// LocalAddrs are local IP addresses to connect from, rotated over the connections
+	LocalAddrs []string
+	// AddressFamily restricts the IP version, used by requests with HappyEyeballs
+	AddressFamily AddressFamily
+	// Trace is called with the Timing of every download attempt of requests without their own Trace
+	Trace TraceFunc
+	// AcceptStatus is used by requests without their own AcceptStatus, nil accepts every status code
+	AcceptStatus func(statusCode int) bool
+
+	cookieJar   *Jar
+	transports  map[transportKey]*http.Transport
+	tlsFiles    fileStamps
+	middlewares []Middleware
+	mu          sync.Mutex
 }
 
 // New 创建一个Surf下载器
 func New() Surfer {
 	s := new(Surf)
-	s.cookieJar, _ = cookiejar.New(nil)
+	s.cookieJar = NewJar()
+	s.Resolver = NewResolver("")
 	return s
 }
 
 // Download 实现surfer下载器接口
 func (surf *Surf) Download(param *Request) (*http.Response, error) {
+	return surf.DownloadContext(context.Background(), param)
+}
+
+// DownloadContext 实现surfer下载器接口，ctx结束时立即中止下载
+func (surf *Surf) DownloadContext(ctx context.Context, param *Request) (*http.Response, error) {
+	param = param.clone()
 	err := param.prepare()
 	if err != nil {
 		return nil, err
 	}
-	param.client = surf.buildClient(param)
-	resp, err := surf.httpRequest(param)
+	ctx, cancel := param.totalContext(ctx)
+	resp, err := surf.httpRequest(ctx, param)
+	if err != nil {
+		cancel()
+	} else {
+		resp.Body = &cancelBody{ReadCloser: resp.Body, cancel: cancel}
+		if param.MaxBodySize > 0 && resp.ContentLength > param.MaxBodySize {
+			resp.Body.Close()
+			err = param.newError(SurfID, attemptOf(resp), ErrBodyTooLarge,
+				fmt.Errorf("Content-Length %d exceeds %d bytes: %w", resp.ContentLength, param.MaxBodySize, ErrBodyTooLarge))
+			resp = nil
+		}
+	}
 
 	if err == nil {
 		switch resp.Header.Get("Content-Encoding") {
@@ -55,96 +116,204 @@ func (surf *Surf) Download(param *Request) (*http.Response, error) {
 			var gzipReader *gzip.Reader
 			gzipReader, err = gzip.NewReader(resp.Body)
 			if err == nil {
-				resp.Body = gzipReader
+				resp.Body = &RespBody{ReadCloser: resp.Body, Reader: gzipReader}
 			}
 
 		case "deflate":
-			resp.Body = flate.NewReader(resp.Body)
+			resp.Body = &RespBody{ReadCloser: resp.Body, Reader: flate.NewReader(resp.Body)}
 
 		case "zlib":
-			var readCloser io.ReadCloser
-			readCloser, err = zlib.NewReader(resp.Body)
+			var reader io.Reader
+			reader, err = zlib.NewReader(resp.Body)
 			if err == nil {
-				resp.Body = readCloser
+				resp.Body = &RespBody{ReadCloser: resp.Body, Reader: reader}
 			}
 		}
+		if param.MaxBodySize > 0 {
+			resp.Body = &limitBody{
+				ReadCloser: resp.Body,
+				remaining:  param.MaxBodySize,
+				err: param.newError(SurfID, attemptOf(resp), ErrBodyTooLarge,
+					fmt.Errorf("body exceeds %d bytes: %w", param.MaxBodySize, ErrBodyTooLarge)),
+			}
+		}
+		if statusErr := param.checkStatus(resp, param.acceptStatus(surf.AcceptStatus)); statusErr != nil {
+			err = param.newError(SurfID, attemptOf(resp), ErrStatus, statusErr)
+		}
 	}
 
 	return param.writeback(resp), err
 }
 
+// Jar returns the cookie jar shared by the requests with EnableCookie and no Session.
+func (surf *Surf) Jar() *Jar {
+	surf.mu.Lock()
+	defer surf.mu.Unlock()
+	// a Surf not created by New starts its jar on first use
+	if surf.cookieJar == nil {
+		surf.cookieJar = NewJar()
+	}
+	return surf.cookieJar
+}
+
 // buildClient creates, configures, and returns a *http.Client type.
-func (surf *Surf) buildClient(req *Request) *http.Client {
+// The client shares the pooled transport; ConnTimeout bounds each attempt,
+// from dialing until the response body is fully read, unless IdleReadTimeout
+// guards the body and httpRequest bounds the attempt until the headers only.
+func (surf *Surf) buildClient(req *Request) (*http.Client, error) {
+	transport, err := surf.transport(req)
+	if err != nil {
+		return nil, err
+	}
 	client := &http.Client{
 		CheckRedirect: req.checkRedirect,
+		Transport:     transport,
 	}
-
-	if req.EnableCookie {
-		client.Jar = surf.cookieJar
-	}
-
-	transport := &http.Transport{
-		Dial: func(network, addr string) (net.Conn, error) {
-			c, err := net.DialTimeout(network, addr, req.DialTimeout)
-			if err != nil {
-				return nil, err
+	if surf.Robots != nil {
+		client.CheckRedirect = func(r *http.Request, via []*http.Request) error {
+			if err := req.checkRedirect(r, via); err != nil {
+				return err
 			}
-			if req.ConnTimeout > 0 {
-				c.SetDeadline(time.Now().Add(req.ConnTimeout))
-			}
-			return c, nil
-		},
+			// the attempt's trace hooks are kept off the robots.txt download
+			return surf.Robots.checkRedirect(valuelessContext{r.Context()}, surf, req, r.URL)
+		}
+	}
+	if req.IdleReadTimeout <= 0 {
+		client.Timeout = req.ConnTimeout
 	}
 
-	if req.proxy != nil {
-		transport.Proxy = http.ProxyURL(req.proxy)
+	if surf.Cache != nil {
+		client.Transport = &cacheTransport{cache: surf.Cache, transport: client.Transport, maxBody: req.MaxBodySize}
 	}
 
-	if strings.ToLower(req.url.Scheme) == "https" {
-		transport.TLSClientConfig = &tls.Config{RootCAs: nil, InsecureSkipVerify: true}
-		transport.DisableCompression = true
+	if req.EnableCookie {
+		client.Jar = req.cookieJar(surf.Jar())
 	}
-	client.Transport = transport
-	return client
+	return client, nil
 }
 
 // send uses the given *http.Request to make an HTTP request.
-func (surf *Surf) httpRequest(param *Request) (resp *http.Response, err error) {
-	req, err := http.NewRequest(param.Method, param.Url, param.body)
-	if err != nil {
-		return nil, err
+// Every attempt sends a new *http.Request; the retry policy decides whether
+// an error or response is retried, and abandoned responses are closed.
+func (surf *Surf) httpRequest(ctx context.Context, param *Request) (resp *http.Response, err error) {
+	policy := param.retryPolicy(surf.RetryPolicy)
+	limiter := param.limiter(surf.Limiter)
+	traceFunc := param.trace(surf.Trace)
+	handler := chain(surf.middlewares, func(req *http.Request) (*http.Response, error) {
+		return param.client.Do(req)
+	})
+	var pool *ProxyPool
+	if param.proxy == nil {
+		pool = surf.ProxyPool
 	}
 
-	req.Header = param.Header
-
-	if param.TryTimes <= 0 {
-		for {
-			resp, err = param.client.Do(req)
-			if err != nil {
-				if !param.EnableCookie {
-					l := len(UserAgents["common"])
-					r := rand.New(rand.NewSource(time.Now().UnixNano()))
-					req.Header.Set("User-Agent", UserAgents["common"][r.Intn(l)])
-				}
-				time.Sleep(param.RetryPause)
-				continue
+	var attempt int
+	var kind error
+	defer func() {
+		if err != nil {
+			if kind == nil && ctx.Err() == nil {
+				kind = classifyError(err)
 			}
-			break
+			err = param.newError(SurfID, attempt, kind, err)
 		}
-	} else {
-		for i := 0; i < param.TryTimes; i++ {
-			resp, err = param.client.Do(req)
-			if err != nil {
-				if !param.EnableCookie {
-					l := len(UserAgents["common"])
-					r := rand.New(rand.NewSource(time.Now().UnixNano()))
-					req.Header.Set("User-Agent", UserAgents["common"][r.Intn(l)])
-				}
-				time.Sleep(param.RetryPause)
-				continue
+	}()
+	for attempt = 1; ; attempt++ {
+		if pool != nil {
+			if param.proxy, err = pool.pick(param); err != nil {
+				return nil, err
+			}
+		}
+		if param.client == nil || pool != nil {
+			if param.client, err = surf.buildClient(param); err != nil {
+				return nil, err
+			}
+		}
+		info := &ResponseInfo{Attempt: attempt, Proxy: param.proxy}
+		trace := newAttemptTrace(param, info, traceFunc)
+		attemptCtx, cancel := context.WithCancelCause(ctx)
+		var req *http.Request
+		if req, err = param.newHTTPRequest(httptrace.WithClientTrace(withInfo(attemptCtx, info), trace.clientTrace())); err != nil {
+			cancel(nil)
+			return nil, err
+		}
+
+		// robots.txt and the limiter only concern requests going to the network
+		cached := surf.Cache != nil && surf.Cache.hit(req)
+		if surf.Robots != nil && !cached {
+			if err = surf.Robots.check(ctx, surf, param, limiter); err != nil {
+				cancel(nil)
+				return nil, err
+			}
+		}
+		release := func() {}
+		if limiter != nil && !cached {
+			if release, err = limiter.Wait(ctx, param.url); err != nil {
+				cancel(nil)
+				return nil, param.contextError(err)
+			}
+		}
+		trace.start()
+		stopHeaderTimer := param.headerTimer(cancel)
+		resp, err = handler(req)
+		if !stopHeaderTimer() && err != nil {
+			err = fmt.Errorf("%w: %v", errHeaderTimeout, err)
+		}
+		if pool != nil && ctx.Err() == nil && (err == nil || proxyFault(err, trace.connected())) {
+			pool.report(param.proxy, resp, err)
+		}
+		if err != nil {
+			release()
+			cancel(nil)
+			trace.finish(err)
+			if ctx.Err() != nil {
+				return nil, err
+			}
+			if trace.tlsError() != nil {
+				err = &TLSError{URL: param.Url, Err: err}
+			}
+			var robotsErr *RobotsError
+			if errors.As(err, &robotsErr) {
+				// a redirect disallowed by robots.txt is not retried
+				kind = ErrRobotsDisallowed
+				return nil, robotsErr
+			}
+			// an HTTP proxy refusing CONNECT fails with a plain error before any connection
+			if kind = classifyError(err); kind == nil && param.proxy != nil && !trace.connected() {
+				kind = ErrProxy
+			}
+		} else {
+			kind = nil
+			info.Protocol = resp.Proto
+			info.StatusCode = resp.StatusCode
+			if resp.Body == nil {
+				resp.Body = http.NoBody
 			}
+			if param.IdleReadTimeout > 0 {
+				idleErr := param.newError(SurfID, attempt, ErrIdleTimeout, param.contextError(ErrIdleTimeout))
+				resp.Body = newIdleBody(attemptCtx, cancel, resp.Body, param.IdleReadTimeout, idleErr)
+			} else {
+				resp.Body = &cancelBody{ReadCloser: resp.Body, cancel: func() { cancel(nil) }}
+			}
+			resp.Body = &releaseBody{ReadCloser: &traceBody{ReadCloser: resp.Body, trace: trace}, release: release}
+		}
+		if param.TryTimes > 0 && attempt >= param.TryTimes {
+			break
+		}
+		retry, wait := policy.Retry(param, attempt, resp, err)
+		if !retry {
 			break
 		}
+		discardResponse(resp)
+		resp = nil
+
+		if !param.EnableCookie {
+			l := len(UserAgents["common"])
+			r := rand.New(rand.NewSource(time.Now().UnixNano()))
+			param.Header.Set("User-Agent", UserAgents["common"][r.Intn(l)])
+		}
+		if err = sleepContext(ctx, wait); err != nil {
+			return nil, param.contextError(err)
+		}
 	}
 
 	return resp, err
@@ -56,6 +56,7 @@
 package surfer
 
 import (
+	"context"
 	"net/http"
 	"sync"
 	// "os"
@@ -75,20 +76,26 @@ var (
 
 // Download 实现surfer下载器接口
 func Download(req *Request) (resp *http.Response, err error) {
+	return DownloadContext(context.Background(), req)
+}
+
+// DownloadContext is like Download, but gives up as soon as ctx is done.
+func DownloadContext(ctx context.Context, req *Request) (resp *http.Response, err error) {
 	switch req.DownloaderID {
 	case SurfID:
 		once_surf.Do(func() { surf = New() })
-		resp, err = surf.Download(req)
+		resp, err = surf.DownloadContext(ctx, req)
 	case PhomtomJsID:
 		once_phantom.Do(func() { phantom = NewPhantom(phantomjsFile, tempJsDir) })
-		resp, err = phantom.Download(req)
+		resp, err = phantom.DownloadContext(ctx, req)
 	}
 	return
 }
 
-// DestroyJsFiles 销毁Phantomjs的js临时文件
+// DestroyJsFiles 销毁Phantomjs的js临时文件，并结束常驻的phantomjs进程
 func DestroyJsFiles() {
 	if pt, ok := phantom.(*Phantom); ok {
+		pt.Close()
 		pt.DestroyJsFiles()
 	}
 }
@@ -100,4 +107,7 @@ type Surfer interface {
 	// POST PostForm @param url, referer string, values url.Values, header http.Header, cookies []*http.Cookie
 	// POST-M PostMultipart @param url, referer string, values url.Values, header http.Header, cookies []*http.Cookie
 	Download(*Request) (resp *http.Response, err error)
+	// DownloadContext is like Download, but the dial, the body read,
+	// the retry pauses and any child process are aborted once ctx is done.
+	DownloadContext(context.Context, *Request) (resp *http.Response, err error)
 }
@@ -17,9 +17,25 @@
 package surfer
 
 import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"testing/iotest"
+	"time"
 )
 
 func TestSurf(t *testing.T) {
@@ -40,3 +56,739 @@ func TestSurf(t *testing.T) {
 	t.Logf("request:\n%#v", req)
 	t.Logf("response:\n%#v\nresponse_body:\n%s", resp, b[:200])
 }
+
+func TestDownloadContext(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/reset" {
+			conn, _, _ := w.(http.Hijacker).Hijack()
+			conn.Close()
+			return
+		}
+		<-r.Context().Done()
+	}))
+	defer srv.Close()
+
+	for _, path := range []string{"/hang", "/reset"} {
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		start := time.Now()
+		_, err := New().DownloadContext(ctx, &Request{
+			Url:        srv.URL + path,
+			TryTimes:   5,
+			RetryPause: time.Minute,
+		})
+		cancel()
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("%s: expected deadline error, got %v", path, err)
+		}
+		if d := time.Since(start); d > 5*time.Second {
+			t.Fatalf("%s: download was not aborted, took %v", path, d)
+		}
+	}
+}
+
+func TestSurfZeroValue(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if c, err := r.Cookie("k"); err == nil {
+			w.Write([]byte(c.Value))
+			return
+		}
+		http.SetCookie(w, &http.Cookie{Name: "k", Value: "v", Path: "/"})
+	}))
+	defer srv.Close()
+
+	s := &Surf{}
+	for i, want := range []string{"", "v"} {
+		resp, err := s.Download(&Request{Url: srv.URL, EnableCookie: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if b, _ := BodyBytes(resp); string(b) != want {
+			t.Errorf("request %d: got %q, want %q", i, b, want)
+		}
+	}
+}
+
+func TestSurfReusesConnections(t *testing.T) {
+	var conns int32
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	srv.Config.ConnState = func(c net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt32(&conns, 1)
+		}
+	}
+	srv.Start()
+	defer srv.Close()
+
+	s := New().(*Surf)
+	defer s.Close()
+	for i := 0; i < 3; i++ {
+		resp, err := s.Download(&Request{Url: srv.URL})
+		if err != nil {
+			t.Fatal(err)
+		}
+		BodyBytes(resp)
+	}
+	if n := atomic.LoadInt32(&conns); n != 1 {
+		t.Fatalf("expected 1 connection, got %d", n)
+	}
+}
+
+func TestSurfRetryPolicy(t *testing.T) {
+	var hits int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&hits, 1) < 3 {
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("ok"))
+	}))
+	defer srv.Close()
+
+	resp, err := New().Download(&Request{
+		Url:         srv.URL,
+		RetryPolicy: &Backoff{Base: time.Millisecond},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := BodyBytes(resp)
+	if resp.StatusCode != http.StatusOK || string(b) != "ok" || atomic.LoadInt32(&hits) != 3 {
+		t.Fatalf("unexpected result: status %d, body %q, hits %d", resp.StatusCode, b, hits)
+	}
+
+	if d, _ := RetryAfter(&http.Response{Header: http.Header{"Retry-After": {"120"}}}); d != 2*time.Minute {
+		t.Fatalf("expected 2m Retry-After, got %v", d)
+	}
+}
+
+func TestVerifyBody(t *testing.T) {
+	body := strings.Repeat("x", 100)
+	src := strings.NewReader(body)
+	resp := &http.Response{Body: ioutil.NopCloser(src)}
+	if err := verifyBody(resp, 10); err != nil {
+		t.Fatal(err)
+	}
+	if read := src.Size() - int64(src.Len()); read > 11 {
+		t.Errorf("buffered %d bytes beyond the limit", read)
+	}
+	if b, _ := ioutil.ReadAll(resp.Body); string(b) != body {
+		t.Errorf("body changed: %q", b)
+	}
+
+	resp = &http.Response{Body: ioutil.NopCloser(io.MultiReader(strings.NewReader("part"), iotest.ErrReader(io.ErrUnexpectedEOF)))}
+	if err := verifyBody(resp, 0); err != io.ErrUnexpectedEOF {
+		t.Errorf("expected the truncated body to fail, got %v", err)
+	}
+}
+
+func TestReplayableBody(t *testing.T) {
+	var hits int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch atomic.AddInt32(&hits, 1) {
+		case 1:
+			ioutil.ReadAll(r.Body)
+			w.WriteHeader(http.StatusBadGateway)
+		case 2:
+			http.Redirect(w, r, "/final", http.StatusTemporaryRedirect)
+		default:
+			if r.ContentLength <= 0 {
+				t.Errorf("expected a known Content-Length, got %d", r.ContentLength)
+			}
+			if err := r.ParseMultipartForm(1 << 20); err != nil {
+				t.Error(err)
+				return
+			}
+			f, _, err := r.FormFile("file")
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			b, _ := ioutil.ReadAll(f)
+			w.Write([]byte(r.FormValue("name") + ":" + string(b)))
+		}
+	}))
+	defer srv.Close()
+
+	resp, err := New().Download(&Request{
+		Url:    srv.URL,
+		Method: "POST",
+		Body: Form{
+			Values: map[string][]string{"name": {"surfer"}},
+			Files:  map[string][]File{"file": {{Filename: "a.txt", Bytes: []byte("content")}}},
+		},
+		RetryPolicy: &Backoff{Base: time.Millisecond},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := BodyBytes(resp); string(b) != "surfer:content" {
+		t.Fatalf("unexpected body %q", b)
+	}
+}
+
+// newFakePhantom returns a Phantom engine running script as its phantomjs binary.
+func newFakePhantom(t *testing.T, script string) *Phantom {
+	dir := t.TempDir()
+	bin := filepath.Join(dir, "phantomjs")
+	if err := ioutil.WriteFile(bin, []byte("#!/bin/sh\n"+script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	return NewPhantom(bin, filepath.Join(dir, "js")).(*Phantom)
+}
+
+func TestMiddleware(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+
+	var attempts int32
+	auth := func(next Handler) Handler {
+		return func(req *http.Request) (*http.Response, error) {
+			atomic.AddInt32(&attempts, 1)
+			req.Header.Set("Authorization", "Bearer token")
+			return next(req)
+		}
+	}
+	synthetic := func(next Handler) Handler {
+		return func(req *http.Request) (*http.Response, error) {
+			if req.URL.Path == "/synthetic" {
+				return &http.Response{
+					StatusCode: http.StatusTeapot,
+					Header:     make(http.Header),
+					Body:       ioutil.NopCloser(strings.NewReader("short-circuit")),
+					Request:    req,
+				}, nil
+			}
+			return next(req)
+		}
+	}
+
+	s := New().(*Surf)
+	s.Use(auth, synthetic)
+	resp, err := s.Download(&Request{Url: srv.URL, TryTimes: 3, RetryPolicy: &Backoff{Base: time.Millisecond}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable || atomic.LoadInt32(&attempts) != 3 {
+		t.Fatalf("expected 3 authorized attempts, got status %d after %d", resp.StatusCode, attempts)
+	}
+
+	p := newFakePhantom(t, "exit 1")
+	p.Use(synthetic)
+	resp, err = p.Download(&Request{Url: srv.URL + "/synthetic", DownloaderID: PhomtomJsID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := BodyBytes(resp); resp.StatusCode != http.StatusTeapot || string(b) != "short-circuit" {
+		t.Fatalf("unexpected phantom response %d %q", resp.StatusCode, b)
+	}
+}
+
+func TestSessions(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if user := r.URL.Query().Get("login"); user != "" {
+			http.SetCookie(w, &http.Cookie{Name: "user", Value: user, Path: "/"})
+			return
+		}
+		c, _ := r.Cookie("user")
+		if c != nil {
+			w.Write([]byte(c.Value + "|"))
+		}
+		w.Write([]byte(r.Header.Get("User-Agent") + "|" + r.Header.Get("X-Team")))
+	}))
+	defer srv.Close()
+
+	alice, bob := NewSession(), NewSession()
+	alice.Header.Set("X-Team", "red")
+	for _, s := range []*Session{alice, bob} {
+		resp, err := s.Download(s.NewRequest(srv.URL + "/?login=" + map[*Session]string{alice: "alice", bob: "bob"}[s]))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+	whoami := func(s *Session) string {
+		resp, err := s.Download(s.NewRequest(srv.URL))
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := BodyBytes(resp)
+		return string(b)
+	}
+	if got := whoami(alice); got != "alice|"+alice.UserAgent+"|red" {
+		t.Fatalf("unexpected alice response %q", got)
+	}
+	if got := whoami(bob); got != "bob|"+bob.UserAgent+"|" {
+		t.Fatalf("unexpected bob response %q", got)
+	}
+
+	clone := alice.Clone()
+	alice.Close()
+	if got := whoami(clone); got != "alice|"+alice.UserAgent+"|red" {
+		t.Fatalf("unexpected clone response %q", got)
+	}
+	if _, err := alice.Download(alice.NewRequest(srv.URL)); err != ErrSessionClosed {
+		t.Fatalf("expected ErrSessionClosed, got %v", err)
+	}
+}
+
+func TestSessionRequestReuse(t *testing.T) {
+	saved := filepath.Join(t.TempDir(), "config.json")
+	// the config file is the last argument, after the proxy options
+	p := newFakePhantom(t, `for f; do :; done; cp "$f" `+saved+` && echo '{"Body": "ok", "Cookies": ["k=v; path=/"]}'`)
+	s := NewSession()
+	s.Proxy = "http://127.0.0.1:8080"
+	s.Header.Set("X-Team", "red")
+	req := &Request{Url: "http://example.com/", DownloaderID: PhomtomJsID, Session: s, TryTimes: 1}
+	for i := 0; i < 3; i++ {
+		if _, err := p.Download(req); err != nil {
+			t.Fatal(err)
+		}
+	}
+	b, err := ioutil.ReadFile(saved)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var config phantomConfig
+	if err = json.Unmarshal(b, &config); err != nil {
+		t.Fatal(err)
+	}
+	if len(config.Cookies) != 1 {
+		t.Errorf("session cookies piled up on the reused request: %+v", config.Cookies)
+	}
+	if req.Proxy != "" || len(req.Header) != 0 {
+		t.Errorf("the session changed the request: proxy %q, header %v", req.Proxy, req.Header)
+	}
+}
+
+func TestProxyPool(t *testing.T) {
+	var good, banned int32
+	goodProxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&good, 1)
+		w.Write([]byte("via good " + r.URL.String()))
+	}))
+	defer goodProxy.Close()
+	bannedProxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&banned, 1)
+		w.WriteHeader(http.StatusForbidden)
+	}))
+	defer bannedProxy.Close()
+
+	pool, err := NewProxyPool(bannedProxy.URL, goodProxy.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := New().(*Surf)
+	s.ProxyPool = pool
+	for i := 0; i < 4; i++ {
+		resp, err := s.Download(&Request{Url: "http://example.com/page"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if info := Info(resp); info == nil || info.Proxy == nil {
+			t.Fatal("proxy not reported on the response")
+		} else if (resp.StatusCode == http.StatusOK) != (info.Proxy.Host == goodProxy.Listener.Addr().String()) {
+			t.Fatalf("status %d reported proxy %v", resp.StatusCode, info.Proxy)
+		}
+	}
+	if banned != 1 || good != 3 {
+		t.Fatalf("banned proxy should be quarantined: banned %d, good %d", banned, good)
+	}
+}
+
+func TestProxyPoolFaults(t *testing.T) {
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/slow":
+			time.Sleep(300 * time.Millisecond)
+		case "/error":
+			w.WriteHeader(http.StatusBadGateway)
+		}
+	}))
+	defer proxy.Close()
+	dead, _ := net.Listen("tcp", "127.0.0.1:0")
+	deadURL := "http://" + dead.Addr().String()
+	dead.Close()
+
+	pool, err := NewProxyPool(proxy.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool.MaxFailures = 1
+	s := New().(*Surf)
+	s.ProxyPool = pool
+	// failures of the target site leave the proxy in rotation
+	for _, path := range []string{"/slow", "/error", "/"} {
+		resp, err := s.Download(&Request{Url: "http://example.com" + path, ResponseHeaderTimeout: 100 * time.Millisecond, TryTimes: 1})
+		if path == "/slow" {
+			if err == nil {
+				t.Error("expected a response header timeout")
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: proxy taken out of rotation: %v", path, err)
+		}
+		resp.Body.Close()
+	}
+
+	// a proxy that cannot be dialled is quarantined
+	if err = pool.Add(deadURL); err != nil {
+		t.Fatal(err)
+	}
+	pool.Remove(proxy.URL)
+	if _, err = s.Download(&Request{Url: "http://example.com/", TryTimes: 1}); !errors.Is(err, ErrProxy) {
+		t.Fatalf("expected a proxy error, got %v", err)
+	}
+	if _, err = s.Download(&Request{Url: "http://example.com/", TryTimes: 1}); !errors.Is(err, ErrNoProxy) {
+		t.Errorf("expected the dead proxy to be quarantined, got %v", err)
+	}
+}
+
+// serveSocks5 runs a SOCKS5 server requiring user/pass, reporting the requested host of every CONNECT.
+func serveSocks5(t *testing.T, hosts chan<- string) net.Listener {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				buf := make([]byte, 512)
+				io.ReadFull(conn, buf[:2])
+				io.ReadFull(conn, buf[:buf[1]])
+				conn.Write([]byte{5, 2})
+				io.ReadFull(conn, buf[:2])
+				user := make([]byte, buf[1])
+				io.ReadFull(conn, user)
+				io.ReadFull(conn, buf[:1])
+				pass := make([]byte, buf[0])
+				io.ReadFull(conn, pass)
+				if string(user) != "user" || string(pass) != "pass" {
+					conn.Write([]byte{1, 1})
+					return
+				}
+				conn.Write([]byte{1, 0})
+				io.ReadFull(conn, buf[:4])
+				var host string
+				switch buf[3] {
+				case 1:
+					io.ReadFull(conn, buf[:4])
+					host = net.IP(buf[:4]).String()
+				case 3:
+					io.ReadFull(conn, buf[:1])
+					name := make([]byte, buf[0])
+					io.ReadFull(conn, name)
+					host = string(name)
+				}
+				io.ReadFull(conn, buf[:2])
+				port := int(buf[0])<<8 | int(buf[1])
+				hosts <- host
+				target, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(port)))
+				if err != nil {
+					conn.Write([]byte{5, 5, 0, 1, 0, 0, 0, 0, 0, 0})
+					return
+				}
+				defer target.Close()
+				conn.Write([]byte{5, 0, 0, 1, 127, 0, 0, 1, 0, 0})
+				go io.Copy(target, conn)
+				io.Copy(conn, target)
+			}()
+		}
+	}()
+	return ln
+}
+
+func TestSocks5Proxy(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer srv.Close()
+	hosts := make(chan string, 10)
+	ln := serveSocks5(t, hosts)
+	defer ln.Close()
+
+	_, port, _ := net.SplitHostPort(srv.Listener.Addr().String())
+	for scheme, want := range map[string]string{"socks5": "127.0.0.1", "socks5h": "localhost"} {
+		resp, err := New().Download(&Request{
+			Url:   "http://localhost:" + port,
+			Proxy: scheme + "://user:pass@" + ln.Addr().String(),
+		})
+		if err != nil {
+			t.Fatalf("%s: %v", scheme, err)
+		}
+		if b, _ := BodyBytes(resp); string(b) != "ok" {
+			t.Fatalf("%s: unexpected body %q", scheme, b)
+		}
+		if host := <-hosts; host != want {
+			t.Fatalf("%s: proxy was asked for %q, want %q", scheme, host, want)
+		}
+	}
+
+	_, err := New().Download(&Request{Url: srv.URL, Proxy: "socks5://user:wrong@" + ln.Addr().String(), TryTimes: 1})
+	if err == nil {
+		t.Fatal("expected an authentication failure")
+	}
+}
+
+func TestHTTPProxyConnectAuth(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer srv.Close()
+	auth := make(chan string, 1)
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth <- r.Header.Get("Proxy-Authorization")
+		target, err := net.Dial("tcp", r.Host)
+		if err != nil {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		conn, _, _ := w.(http.Hijacker).Hijack()
+		go io.Copy(target, conn)
+		io.Copy(conn, target)
+		conn.Close()
+		target.Close()
+	}))
+	defer proxy.Close()
+
+	resp, err := New().Download(&Request{Url: srv.URL, Proxy: "http://us%40er:p%3Ass@" + proxy.Listener.Addr().String()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if got := <-auth; got != "Basic dXNAZXI6cDpzcw==" {
+		t.Fatalf("unexpected Proxy-Authorization %q", got)
+	}
+}
+
+func TestPhantomProxyArgs(t *testing.T) {
+	p := newFakePhantom(t, `printf '{"Cookies":[],"Body":"%s %s %s"}' "$1" "$2" "$3"`)
+	resp, err := p.Download(&Request{Url: "http://example.com", Proxy: "socks5://u:p@10.0.0.1:1081"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := BodyBytes(resp); string(b) != "--proxy=10.0.0.1:1081 --proxy-type=socks5 --proxy-auth=u:p" {
+		t.Fatalf("unexpected phantomjs args %q", b)
+	}
+}
+
+func TestTLSConfig(t *testing.T) {
+	var closed int32
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	srv.Config.ConnState = func(c net.Conn, state http.ConnState) {
+		if state == http.StateClosed {
+			atomic.AddInt32(&closed, 1)
+		}
+	}
+	srv.StartTLS()
+	defer srv.Close()
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	ioutil.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw}), 0644)
+
+	_, err := New().Download(&Request{Url: srv.URL, TryTimes: 1, TLS: &TLSConfig{Verify: true}})
+	var tlsErr *TLSError
+	if !errors.As(err, &tlsErr) {
+		t.Fatalf("expected *TLSError, got %v", err)
+	}
+
+	s := New().(*Surf)
+	s.TLS = &TLSConfig{Verify: true, RootCAFiles: []string{caFile}, ServerName: "example.com", MinVersion: tls.VersionTLS12}
+	download := func() *http.Transport {
+		resp, err := s.Download(&Request{Url: srv.URL, TryTimes: 1})
+		if err != nil {
+			t.Fatal(err)
+		}
+		BodyBytes(resp)
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if len(s.transports) != 1 {
+			t.Fatalf("expected 1 pooled transport, got %d", len(s.transports))
+		}
+		for _, t := range s.transports {
+			return t
+		}
+		return nil
+	}
+	first := download()
+
+	// files rewritten on disk get a new transport, which loads them again,
+	// and the former one is dropped with its idle connections
+	later := time.Now().Add(time.Minute)
+	if err = os.Chtimes(caFile, later, later); err != nil {
+		t.Fatal(err)
+	}
+	if download() != first {
+		t.Error("the files were checked again within tlsFileCheckInterval")
+	}
+	time.Sleep(tlsFileCheckInterval)
+	atomic.StoreInt32(&closed, 0)
+	if download() == first {
+		t.Error("the transport cache ignores rotated files")
+	}
+	for deadline := time.Now().Add(time.Second); atomic.LoadInt32(&closed) == 0; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("the idle connection of the replaced transport was not closed")
+		}
+	}
+}
+
+func TestHTTPVersion(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Proto))
+	})
+	tlsSrv := httptest.NewUnstartedServer(handler)
+	tlsSrv.EnableHTTP2 = true
+	tlsSrv.StartTLS()
+	defer tlsSrv.Close()
+	h2cSrv := httptest.NewUnstartedServer(handler)
+	h2cSrv.Config.Protocols = new(http.Protocols)
+	h2cSrv.Config.Protocols.SetHTTP1(true)
+	h2cSrv.Config.Protocols.SetUnencryptedHTTP2(true)
+	h2cSrv.Start()
+	defer h2cSrv.Close()
+
+	cases := []struct {
+		url     string
+		version HTTPVersion
+		want    string
+	}{
+		{tlsSrv.URL, HTTPAuto, "HTTP/2.0"},
+		{tlsSrv.URL, HTTP1, "HTTP/1.1"},
+		{h2cSrv.URL, HTTPAuto, "HTTP/1.1"},
+		{h2cSrv.URL, HTTP2, "HTTP/2.0"},
+	}
+	s := New()
+	for _, c := range cases {
+		resp, err := s.Download(&Request{Url: c.url, HTTPVersion: c.version})
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := BodyBytes(resp)
+		if string(b) != c.want || resp.Proto != c.want || Info(resp).Protocol != c.want {
+			t.Errorf("%s with version %d: server saw %s, response says %s", c.url, c.version, b, resp.Proto)
+		}
+	}
+}
+
+func TestTiming(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("fail") != "" {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		time.Sleep(20 * time.Millisecond)
+		w.(http.Flusher).Flush()
+		time.Sleep(20 * time.Millisecond)
+		w.Write([]byte("ok"))
+	}))
+	defer srv.Close()
+	_, port, _ := net.SplitHostPort(srv.Listener.Addr().String())
+
+	var mu sync.Mutex
+	var traced []ResponseInfo
+	s := &Surf{
+		Trace: func(req *Request, info *ResponseInfo, err error) {
+			mu.Lock()
+			traced = append(traced, *info)
+			mu.Unlock()
+		},
+	}
+	s.Resolver = NewResolver("")
+	url := "https://localhost:" + port + "/"
+	for i := 0; i < 2; i++ {
+		resp, err := s.Download(&Request{Url: url})
+		if err != nil {
+			t.Fatal(err)
+		}
+		BodyBytes(resp)
+		timing := Info(resp).Timing
+		if i == 0 {
+			if timing.Reused || timing.DNS <= 0 || timing.Connect <= 0 || timing.TLS <= 0 {
+				t.Errorf("missing connection phases: %+v", timing)
+			}
+		} else if !timing.Reused || timing.Connect != 0 || timing.TLS != 0 {
+			t.Errorf("expected a reused connection: %+v", timing)
+		}
+		if timing.TTFB < 20*time.Millisecond || timing.Transfer < 20*time.Millisecond ||
+			timing.Total < timing.TTFB+timing.Transfer {
+			t.Errorf("unexpected timing: %+v", timing)
+		}
+	}
+
+	retryAll := RetryPolicyFunc(func(*Request, int, *http.Response, error) (bool, time.Duration) {
+		return true, 0
+	})
+	resp, err := s.Download(&Request{Url: url + "?fail=1", TryTimes: 2, RetryPolicy: retryAll})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	mu.Lock()
+	defer mu.Unlock()
+	if len(traced) != 4 {
+		t.Fatalf("traced %d attempts, want 4", len(traced))
+	}
+	if traced[2].Attempt != 1 || traced[3].Attempt != 2 || traced[3].StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("unexpected attempts: %+v", traced[2:])
+	}
+}
+
+func TestPhantomResponse(t *testing.T) {
+	p := newFakePhantom(t, `cat <<'EOF'
+{"Body": "<html>missing</html>", "Status": 404, "StatusText": "Not Found",
+ "Headers": [{"Name": "content-type", "Value": "text/html; charset=gbk"}, {"Name": "Content-Encoding", "Value": "gzip"}, {"Name": "X-Multi", "Value": "a\nb"}],
+ "URL": "http://example.com/moved", "Cookies": ["k=v; path=/"]}
+EOF`)
+	resp, err := p.Download(&Request{Url: "http://example.com/", DownloaderID: PhomtomJsID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != 404 || resp.Status != "404 Not Found" {
+		t.Errorf("unexpected status %d %q", resp.StatusCode, resp.Status)
+	}
+	if resp.Header.Get("Content-Type") != "text/html; charset=gbk" || resp.Header.Get("Content-Encoding") != "" ||
+		len(resp.Header["X-Multi"]) != 2 || resp.Header.Get("Set-Cookie") != "k=v; path=/" {
+		t.Errorf("unexpected headers %v", resp.Header)
+	}
+	if resp.Request.URL.String() != "http://example.com/moved" {
+		t.Errorf("final URL %s", resp.Request.URL)
+	}
+}
+
+func TestPhantomRetryForever(t *testing.T) {
+	count := filepath.Join(t.TempDir(), "count")
+	// fails twice, then succeeds with a cookie
+	p := newFakePhantom(t, `echo x >> `+count+`
+[ $(wc -l < `+count+`) -gt 2 ] || exit 1
+echo '{"Body": "ok", "Cookies": ["k=v; path=/"]}'`)
+	s := NewSession()
+	resp, err := p.Download(&Request{Url: "http://example.com/", DownloaderID: PhomtomJsID, Session: s, TryTimes: -1, RetryPause: time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info := Info(resp); info == nil || info.Attempt != 3 {
+		t.Errorf("expected success on the 3rd attempt, got %+v", info)
+	}
+	if cookies := s.Jar().Cookies(resp.Request.URL); len(cookies) != 1 || cookies[0].Name != "k" {
+		t.Errorf("session cookies %v", cookies)
+	}
+}
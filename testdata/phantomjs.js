@@ -0,0 +1,194 @@
+// A stand-in for the phantomjs binary that runs the embedded script under node:
+//
+//     node phantomjs.js [--proxy options] script.js [args...]
+//
+// The pages it serves are described by the JSON file in $PHANTOM_MOCK, keyed by
+// URL path, and every page opened is recorded as a JSON line in $PHANTOM_MOCK_RECORD.
+'use strict';
+
+var nodeFs = require('fs');
+var path = require('path');
+
+var args = process.argv.slice(2).filter(function(a) {
+    return a.indexOf('--') !== 0;
+});
+var pages = JSON.parse(nodeFs.readFileSync(process.env.PHANTOM_MOCK, 'utf8'));
+
+function record(entry) {
+    nodeFs.appendFileSync(process.env.PHANTOM_MOCK_RECORD, JSON.stringify(entry) + '\n');
+}
+
+var jar = [];
+var proxy = null;
+
+var system = {
+    args: args,
+    stdin: {
+        readLine: function() {
+            var line = '';
+            var buf = Buffer.alloc(1);
+            for (;;) {
+                var n;
+                try {
+                    n = nodeFs.readSync(0, buf, 0, 1, null);
+                } catch (e) {
+                    if (e.code === 'EAGAIN') {
+                        continue;
+                    }
+                    throw e;
+                }
+                if (n === 0 || buf[0] === 10) {
+                    return line;
+                }
+                line += String.fromCharCode(buf[0]);
+            }
+        }
+    }
+};
+
+var fs = {
+    read: function(name) {
+        return nodeFs.readFileSync(name, 'utf8');
+    }
+};
+
+global.phantom = {
+    outputEncoding: 'utf-8',
+    exit: function() {
+        process.exit(0);
+    },
+    addCookie: function(c) {
+        jar.push(c);
+    },
+    clearCookies: function() {
+        jar = [];
+    },
+    setProxy: function(host, port, type, user, password) {
+        proxy = host ? {host: host, port: port, type: type, user: user, password: password} : null;
+    }
+};
+
+// the DOM of the open page as seen by page.evaluate: elements and window
+// variables show up the given number of milliseconds after page.open
+var spec = {};
+var opened = 0;
+var scrolls = 0;
+function since(ms) {
+    return ms !== undefined && Date.now() - opened >= ms;
+}
+global.document = {
+    body: {scrollHeight: 1000},
+    querySelector: function(selector) {
+        return since((spec.elements || {})[selector]) ? {} : null;
+    }
+};
+global.window = {
+    scrollTo: function() {
+        scrolls++;
+    }
+};
+
+var webpage = {
+    create: function() {
+        var timers = [];
+        var later = function(fn, ms) {
+            timers.push(setTimeout(fn, ms));
+        };
+        var content = '';
+        var page = {
+            settings: {},
+            customHeaders: {},
+            url: '',
+            cookies: [],
+            get content() {
+                return content.replace('{scrolls}', scrolls);
+            },
+            evaluate: function(fn) {
+                return fn.apply(null, Array.prototype.slice.call(arguments, 1));
+            },
+            close: function() {
+                timers.forEach(clearTimeout);
+            },
+            open: function(url, settings, callback) {
+                var u = new URL(url);
+                spec = pages[u.pathname] || {};
+                opened = Date.now();
+                scrolls = 0;
+                Object.keys(spec.vars || {}).forEach(function(name) {
+                    Object.defineProperty(global.window, name, {
+                        configurable: true,
+                        get: function() {
+                            return since(spec.vars[name]);
+                        }
+                    });
+                });
+                record({
+                    pid: process.pid,
+                    url: url,
+                    settings: settings,
+                    customHeaders: page.customHeaders,
+                    userAgent: page.settings.userAgent,
+                    userName: page.settings.userName,
+                    password: page.settings.password,
+                    resourceTimeout: page.settings.resourceTimeout,
+                    cookies: jar,
+                    proxy: proxy
+                });
+                page.url = url;
+                if (spec.garbage) {
+                    console.log(spec.garbage);
+                }
+                page.onResourceRequested({id: 1, url: url}, {});
+                // a redirect of the main document, the page ends up at spec.redirect
+                var final = u;
+                var mainId = 1;
+                if (spec.redirect) {
+                    final = new URL(spec.redirect);
+                    mainId = 100;
+                    page.onResourceReceived({id: 1, stage: 'end', url: url, status: 302, redirectURL: final.href});
+                    page.onResourceRequested({id: mainId, url: final.href}, {});
+                }
+                (spec.resources || []).forEach(function(r, i) {
+                    var res = {id: i + 2, url: u.origin + '/resource' + i};
+                    later(function() {
+                        page.onResourceRequested(res, {});
+                    }, r.at);
+                    later(function() {
+                        page.onResourceReceived({id: res.id, url: res.url, stage: 'end', status: 200});
+                    }, r.at + r.duration);
+                });
+                later(function() {
+                    if (spec.crash) {
+                        process.exit(1);
+                    }
+                    if (spec.fail) {
+                        callback('fail');
+                        return;
+                    }
+                    page.onResourceReceived({
+                        id: mainId,
+                        stage: 'end',
+                        url: final.href,
+                        status: spec.status || 200,
+                        statusText: spec.statusText || 'OK',
+                        headers: spec.headers || []
+                    });
+                    content = spec.content || '<html></html>';
+                    jar = jar.concat(spec.cookies || []);
+                    page.url = final.href;
+                    page.cookies = jar.filter(function(c) {
+                        return ('.' + final.hostname).endsWith('.' + c.domain.replace(/^\./, ''));
+                    });
+                    callback('success');
+                }, spec.load || 0);
+            }
+        };
+        return page;
+    }
+};
+
+var modules = {system: system, fs: fs, webpage: webpage};
+var script = nodeFs.readFileSync(path.resolve(args[0]), 'utf8');
+new Function('require', script)(function(name) {
+    return modules[name];
+});
@@ -0,0 +1,107 @@
+// Copyright 2015 henrylee2cn Author. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package surfer
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync"
+	"time"
+)
+
+// ErrIdleTimeout is returned when no response data arrived within Request.IdleReadTimeout.
+var ErrIdleTimeout = errors.New("surfer: no data received within the idle read timeout")
+
+// errPhantomTLSTimeout is returned for phantom requests with a TLSHandshakeTimeout:
+// phantomjs bounds each resource as a whole only, see ResponseHeaderTimeout.
+var errPhantomTLSTimeout = errors.New("surfer: the phantom engine cannot limit the TLS handshake, use ResponseHeaderTimeout to bound each resource")
+
+// errHeaderTimeout fails an attempt whose response headers did not arrive within ConnTimeout.
+var errHeaderTimeout = errors.New("surfer: no response headers within ConnTimeout")
+
+// headerTimer cancels the attempt when its response headers do not arrive within
+// ConnTimeout, for downloads where IdleReadTimeout rather than ConnTimeout guards
+// the body. The returned func stops the timer and reports false when it had fired.
+func (r *Request) headerTimer(cancel context.CancelCauseFunc) func() bool {
+	if r.IdleReadTimeout <= 0 || r.ConnTimeout <= 0 {
+		return func() bool { return true }
+	}
+	timer := time.AfterFunc(r.ConnTimeout, func() { cancel(errHeaderTimeout) })
+	return timer.Stop
+}
+
+// totalContext bounds ctx by TotalTimeout; the CancelFunc must be called
+// once the download and its response body are done with.
+func (r *Request) totalContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if r.TotalTimeout > 0 {
+		return context.WithTimeout(ctx, r.TotalTimeout)
+	}
+	return ctx, func() {}
+}
+
+// cancelBody calls cancel once the response body is closed.
+type cancelBody struct {
+	io.ReadCloser
+	once   sync.Once
+	cancel func()
+}
+
+func (b *cancelBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(b.cancel)
+	return err
+}
+
+// idleBody cancels the download attempt when no data arrives for timeout.
+type idleBody struct {
+	io.ReadCloser
+	ctx     context.Context
+	cancel  context.CancelCauseFunc
+	timer   *time.Timer
+	timeout time.Duration
+	// err is returned once the attempt was cancelled for being idle
+	err error
+}
+
+// newIdleBody starts watching body; ctx is the attempt's context and cancel its CancelCauseFunc.
+func newIdleBody(ctx context.Context, cancel context.CancelCauseFunc, body io.ReadCloser, timeout time.Duration, err error) *idleBody {
+	return &idleBody{
+		ReadCloser: body,
+		ctx:        ctx,
+		cancel:     cancel,
+		timer:      time.AfterFunc(timeout, func() { cancel(ErrIdleTimeout) }),
+		timeout:    timeout,
+		err:        err,
+	}
+}
+
+func (b *idleBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if n > 0 {
+		b.timer.Reset(b.timeout)
+	}
+	if err != nil && err != io.EOF && context.Cause(b.ctx) == ErrIdleTimeout {
+		err = b.err
+	}
+	return n, err
+}
+
+func (b *idleBody) Close() error {
+	b.timer.Stop()
+	err := b.ReadCloser.Close()
+	b.cancel(nil)
+	return err
+}
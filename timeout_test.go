@@ -0,0 +1,111 @@
+// Copyright 2015 henrylee2cn Author. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package surfer
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestTimeouts(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/slow-header":
+			time.Sleep(300 * time.Millisecond)
+		case "/trickle":
+			// 500ms in total, but never idle for more than 50ms
+			for i := 0; i < 10; i++ {
+				w.Write([]byte("x"))
+				w.(http.Flusher).Flush()
+				time.Sleep(50 * time.Millisecond)
+			}
+		case "/stall":
+			w.Write([]byte("x"))
+			w.(http.Flusher).Flush()
+			select {
+			case <-r.Context().Done():
+			case <-time.After(2 * time.Second):
+			}
+		case "/unavailable":
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer srv.Close()
+	s := New()
+
+	_, err := s.Download(&Request{Url: srv.URL + "/slow-header", ResponseHeaderTimeout: 100 * time.Millisecond, TryTimes: 1})
+	if err == nil {
+		t.Error("expected a response header timeout")
+	}
+
+	_, err = s.Download(&Request{Url: srv.URL + "/slow-header", ConnTimeout: 100 * time.Millisecond, IdleReadTimeout: time.Second, TryTimes: 1})
+	if !errors.Is(err, errHeaderTimeout) {
+		t.Errorf("expected ConnTimeout to bound the headers, got %v", err)
+	}
+
+	// ConnTimeout ends with the headers, the idle timeout guards the body
+	resp, err := s.Download(&Request{Url: srv.URL + "/trickle", ConnTimeout: 200 * time.Millisecond, IdleReadTimeout: 100 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, err := BodyBytes(resp); err != nil || len(b) != 10 {
+		t.Errorf("slow but steady download failed: %q %v", b, err)
+	}
+
+	resp, err = s.Download(&Request{Url: srv.URL + "/stall", IdleReadTimeout: 100 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	_, err = ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if !errors.Is(err, ErrIdleTimeout) || time.Since(start) > time.Second {
+		t.Errorf("expected an idle timeout, got %v after %v", err, time.Since(start))
+	}
+
+	retryAll := RetryPolicyFunc(func(*Request, int, *http.Response, error) (bool, time.Duration) {
+		return true, 50 * time.Millisecond
+	})
+	start = time.Now()
+	_, err = s.Download(&Request{Url: srv.URL + "/unavailable", TryTimes: -1, RetryPolicy: retryAll, TotalTimeout: 200 * time.Millisecond})
+	if !errors.Is(err, context.DeadlineExceeded) || time.Since(start) > time.Second {
+		t.Errorf("expected the total timeout, got %v after %v", err, time.Since(start))
+	}
+
+	p := newFakePhantom(t, `if grep -q '"idleTimeout":100,"resourceTimeout":300' "$2"; then echo '{"Error": "idle timeout"}'; else echo '{"Body": "ok"}'; fi`)
+	_, err = p.Download(&Request{
+		Url:                   srv.URL,
+		IdleReadTimeout:       100 * time.Millisecond,
+		ResponseHeaderTimeout: 300 * time.Millisecond,
+		TryTimes:              1,
+		DownloaderID:          PhomtomJsID,
+	})
+	if !errors.Is(err, ErrIdleTimeout) {
+		t.Errorf("expected phantom idle timeout, got %v", err)
+	}
+	_, err = p.Download(&Request{Url: srv.URL, TLSHandshakeTimeout: time.Second, DownloaderID: PhomtomJsID})
+	if err != errPhantomTLSTimeout {
+		t.Errorf("expected the phantom engine to reject TLSHandshakeTimeout, got %v", err)
+	}
+	_, err = newFakePhantom(t, "exec sleep 2").Download(&Request{Url: srv.URL, TotalTimeout: 100 * time.Millisecond, DownloaderID: PhomtomJsID})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected phantom total timeout, got %v", err)
+	}
+}
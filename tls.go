@@ -0,0 +1,172 @@
+// Copyright 2015 henrylee2cn Author. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package surfer
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+)
+
+// tlsFileCheckInterval is how often the TLS files are checked for changes.
+const tlsFileCheckInterval = time.Second
+
+// TLSConfig configures the HTTPS connections of the Surf engine.
+// The zero value keeps the historical behavior of skipping certificate verification.
+type TLSConfig struct {
+	// Verify enables certificate verification
+	Verify bool
+	// RootCAFiles are PEM files of extra trusted root CAs, added to the system pool
+	RootCAFiles []string
+	// Certificates are the client certificate/key pairs presented for mutual TLS
+	Certificates []CertFiles
+	// MinVersion is the minimum TLS version, e.g. tls.VersionTLS12 (0 means the Go default)
+	MinVersion uint16
+	// ServerName overrides the host name used for SNI and certificate verification
+	ServerName string
+}
+
+// CertFiles names the PEM files of a client certificate and its private key.
+type CertFiles struct {
+	CertFile string
+	KeyFile  string
+}
+
+// key identifies the configuration in the transport cache.
+func (c *TLSConfig) key() string {
+	if c == nil {
+		return ""
+	}
+	return fmt.Sprintf("%t|%q|%q|%d|%s", c.Verify, c.RootCAFiles, c.Certificates, c.MinVersion, c.ServerName)
+}
+
+// files returns the files loaded by build.
+func (c *TLSConfig) files() []string {
+	if c == nil {
+		return nil
+	}
+	files := append([]string(nil), c.RootCAFiles...)
+	for _, cert := range c.Certificates {
+		files = append(files, cert.CertFile, cert.KeyFile)
+	}
+	return files
+}
+
+// fileStamps caches the modification times of the TLS files, so that
+// certificates rotated on disk are noticed without a stat per download.
+type fileStamps struct {
+	mu    sync.Mutex
+	files map[string]fileStamp
+}
+
+type fileStamp struct {
+	modTime int64
+	checked time.Time
+}
+
+// get returns the modification times of files, each checked at most once per tlsFileCheckInterval.
+func (s *fileStamps) get(files []string) string {
+	if len(files) == 0 {
+		return ""
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.files == nil {
+		s.files = make(map[string]fileStamp)
+	}
+	now := time.Now()
+	modTimes := make([]int64, len(files))
+	for i, file := range files {
+		stamp, ok := s.files[file]
+		if !ok || now.Sub(stamp.checked) >= tlsFileCheckInterval {
+			stamp = fileStamp{checked: now}
+			if fi, err := os.Stat(file); err == nil {
+				stamp.modTime = fi.ModTime().UnixNano()
+			}
+			s.files[file] = stamp
+		}
+		modTimes[i] = stamp.modTime
+	}
+	return fmt.Sprint(modTimes)
+}
+
+// build loads the files of c and returns the equivalent *tls.Config.
+func (c *TLSConfig) build() (*tls.Config, error) {
+	if c == nil {
+		return &tls.Config{RootCAs: nil, InsecureSkipVerify: true}, nil
+	}
+	config := &tls.Config{
+		InsecureSkipVerify: !c.Verify,
+		MinVersion:         c.MinVersion,
+		ServerName:         c.ServerName,
+	}
+	if len(c.RootCAFiles) > 0 {
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		for _, file := range c.RootCAFiles {
+			pem, err := ioutil.ReadFile(file)
+			if err != nil {
+				return nil, err
+			}
+			if !pool.AppendCertsFromPEM(pem) {
+				return nil, fmt.Errorf("surfer: no certificates found in %s", file)
+			}
+		}
+		config.RootCAs = pool
+	}
+	for _, files := range c.Certificates {
+		cert, err := tls.LoadX509KeyPair(files.CertFile, files.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = append(config.Certificates, cert)
+	}
+	return config, nil
+}
+
+// tlsConfig returns the TLSConfig in effect, the request's own one overriding the engine's.
+func (r *Request) tlsConfig(engine *TLSConfig) *TLSConfig {
+	if r.TLS != nil {
+		return r.TLS
+	}
+	return engine
+}
+
+// TLSError reports a failed TLS handshake, e.g. an untrusted certificate
+// or a server rejecting the client certificate.
+type TLSError struct {
+	URL string
+	Err error
+}
+
+func (e *TLSError) Error() string {
+	return fmt.Sprintf("surfer: TLS handshake with %s failed: %v", e.URL, e.Err)
+}
+
+// Unwrap returns the underlying error.
+func (e *TLSError) Unwrap() error {
+	return e.Err
+}
+
+// Is reports whether target is ErrTLS.
+func (e *TLSError) Is(target error) bool {
+	return target == ErrTLS
+}
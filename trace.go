@@ -0,0 +1,199 @@
+// Copyright 2015 henrylee2cn Author. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package surfer
+
+import (
+	"crypto/tls"
+	"io"
+	"net/http/httptrace"
+	"sync"
+	"time"
+)
+
+// Timing holds how long the phases of one download attempt took.
+// Phases that did not happen, like DNS and TLS on a reused connection, are 0;
+// after redirects they describe the last request.
+type Timing struct {
+	// Start is when the attempt started sending the request
+	Start time.Time
+	// DNS is the duration of the DNS lookup
+	DNS time.Duration
+	// Connect is the duration of the TCP connect
+	Connect time.Duration
+	// TLS is the duration of the TLS handshake
+	TLS time.Duration
+	// TTFB is the time from Start until the first response byte
+	TTFB time.Duration
+	// Transfer is the time from the first response byte until the body was read or closed
+	Transfer time.Duration
+	// Total is the time from Start until the body was read or closed, or the attempt failed
+	Total time.Duration
+	// Reused reports whether the connection had served requests before
+	Reused bool
+}
+
+// TraceFunc is called at the end of every download attempt, e.g. to feed metrics:
+// on failure with the error, otherwise once the response body was read or closed.
+type TraceFunc func(req *Request, info *ResponseInfo, err error)
+
+// trace returns the TraceFunc in effect, the request's own one overriding the engine's.
+func (r *Request) trace(engine TraceFunc) TraceFunc {
+	if r.Trace != nil {
+		return r.Trace
+	}
+	return engine
+}
+
+// attemptTrace collects the Timing of one attempt into info.
+type attemptTrace struct {
+	req  *Request
+	info *ResponseInfo
+	fn   TraceFunc
+
+	mu        sync.Mutex
+	dnsStart  time.Time
+	connStart time.Time
+	tlsStart  time.Time
+	firstByte time.Time
+	tlsErr    error
+	gotConn   bool
+	once      sync.Once
+}
+
+func newAttemptTrace(req *Request, info *ResponseInfo, fn TraceFunc) *attemptTrace {
+	return &attemptTrace{req: req, info: info, fn: fn}
+}
+
+// start marks the start of sending the request.
+func (t *attemptTrace) start() {
+	t.mu.Lock()
+	t.info.Timing.Start = time.Now()
+	t.mu.Unlock()
+}
+
+// clientTrace returns the httptrace hooks recording the phases.
+func (t *attemptTrace) clientTrace() *httptrace.ClientTrace {
+	timing := &t.info.Timing
+	return &httptrace.ClientTrace{
+		GetConn: func(string) {
+			t.mu.Lock()
+			timing.DNS, timing.Connect, timing.TLS, timing.Reused = 0, 0, 0, false
+			t.connStart = time.Time{}
+			t.mu.Unlock()
+		},
+		DNSStart: func(httptrace.DNSStartInfo) {
+			t.mu.Lock()
+			t.dnsStart = time.Now()
+			t.mu.Unlock()
+		},
+		DNSDone: func(httptrace.DNSDoneInfo) {
+			t.mu.Lock()
+			timing.DNS = time.Since(t.dnsStart)
+			t.mu.Unlock()
+		},
+		ConnectStart: func(_, _ string) {
+			t.mu.Lock()
+			if t.connStart.IsZero() {
+				t.connStart = time.Now()
+			}
+			t.mu.Unlock()
+		},
+		ConnectDone: func(_, _ string, err error) {
+			t.mu.Lock()
+			if err == nil && timing.Connect == 0 {
+				timing.Connect = time.Since(t.connStart)
+			}
+			t.mu.Unlock()
+		},
+		TLSHandshakeStart: func() {
+			t.mu.Lock()
+			t.tlsStart = time.Now()
+			t.mu.Unlock()
+		},
+		TLSHandshakeDone: func(_ tls.ConnectionState, err error) {
+			t.mu.Lock()
+			timing.TLS = time.Since(t.tlsStart)
+			if err != nil {
+				t.tlsErr = err
+			}
+			t.mu.Unlock()
+		},
+		GotConn: func(conn httptrace.GotConnInfo) {
+			t.mu.Lock()
+			t.gotConn = true
+			t.info.LocalAddr = conn.Conn.LocalAddr()
+			timing.Reused = conn.Reused
+			t.mu.Unlock()
+		},
+		GotFirstResponseByte: func() {
+			t.mu.Lock()
+			t.firstByte = time.Now()
+			timing.TTFB = t.firstByte.Sub(timing.Start)
+			t.mu.Unlock()
+		},
+	}
+}
+
+// tlsError returns the error of a failed TLS handshake.
+func (t *attemptTrace) tlsError() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.tlsErr
+}
+
+// connected reports whether a connection to the server, or through the proxy, was obtained.
+func (t *attemptTrace) connected() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.gotConn
+}
+
+// finish completes the Timing and calls the TraceFunc, once.
+func (t *attemptTrace) finish(err error) {
+	t.once.Do(func() {
+		t.mu.Lock()
+		now := time.Now()
+		if !t.firstByte.IsZero() {
+			t.info.Timing.Transfer = now.Sub(t.firstByte)
+		}
+		t.info.Timing.Total = now.Sub(t.info.Timing.Start)
+		t.mu.Unlock()
+		if t.fn != nil {
+			t.fn(t.req, t.info, err)
+		}
+	})
+}
+
+// traceBody finishes an attemptTrace when the body is read to the end, fails or is closed.
+type traceBody struct {
+	io.ReadCloser
+	trace *attemptTrace
+}
+
+func (b *traceBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if err == io.EOF {
+		b.trace.finish(nil)
+	} else if err != nil {
+		b.trace.finish(err)
+	}
+	return n, err
+}
+
+func (b *traceBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.trace.finish(nil)
+	return err
+}
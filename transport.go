@@ -0,0 +1,183 @@
+// Copyright 2015 henrylee2cn Author. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package surfer
+
+import (
+	"net/http"
+	"strings"
+	"time"
+)
+
+// HTTPVersion selects the HTTP protocol version of the Surf engine.
+type HTTPVersion int
+
+// HTTP versions
+const (
+	// HTTPAuto negotiates HTTP/2 via ALPN on HTTPS and falls back to HTTP/1.1
+	HTTPAuto HTTPVersion = iota
+	// HTTP1 forces HTTP/1.1
+	HTTP1
+	// HTTP2 forces HTTP/2, over TLS or as cleartext h2c with prior knowledge for http:// URLs
+	HTTP2
+)
+
+// httpVersion returns the HTTPVersion in effect, the request's own one overriding the engine's.
+func (r *Request) httpVersion(engine HTTPVersion) HTTPVersion {
+	if r.HTTPVersion != HTTPAuto {
+		return r.HTTPVersion
+	}
+	return engine
+}
+
+// transportKey 区分需要独立*http.Transport的请求设置，
+// 设置相同的请求共享同一连接池
+type transportKey struct {
+	proxy       string
+	https       bool
+	tls         string
+	tlsFiles    string // modification times of the TLS files
+	httpVersion HTTPVersion
+	hosts       string
+	family      AddressFamily
+	localAddrs  string
+	dialTimeout time.Duration
+	// TLS handshake and response header timeouts
+	tlsTimeout    time.Duration
+	headerTimeout time.Duration
+}
+
+// withoutFiles returns k without the modification times of the TLS files.
+func (k transportKey) withoutFiles() transportKey {
+	k.tlsFiles = ""
+	return k
+}
+
+// transport returns the pooled *http.Transport matching req's settings,
+// creating it on first use.
+func (surf *Surf) transport(req *Request) (*http.Transport, error) {
+	tlsConfig := req.tlsConfig(surf.TLS)
+	hosts := req.mergeHosts(surf.Resolve)
+	localAddrs := req.localAddrs(surf.LocalAddrs)
+	key := transportKey{
+		https:         strings.ToLower(req.url.Scheme) == "https",
+		tls:           tlsConfig.key(),
+		tlsFiles:      surf.tlsFiles.get(tlsConfig.files()),
+		httpVersion:   req.httpVersion(surf.HTTPVersion),
+		hosts:         hostsKey(hosts),
+		family:        req.addressFamily(surf.AddressFamily),
+		localAddrs:    strings.Join(localAddrs, ","),
+		dialTimeout:   req.DialTimeout,
+		tlsTimeout:    req.TLSHandshakeTimeout,
+		headerTimeout: req.ResponseHeaderTimeout,
+	}
+	if req.proxy != nil {
+		key.proxy = req.proxy.String()
+	}
+
+	surf.mu.Lock()
+	defer surf.mu.Unlock()
+	if t, ok := surf.transports[key]; ok {
+		return t, nil
+	}
+
+	config, err := tlsConfig.build()
+	if err != nil {
+		return nil, err
+	}
+	local, err := parseLocalAddrs(localAddrs)
+	if err != nil {
+		return nil, err
+	}
+
+	dialer := &hostDialer{
+		timeout:  key.dialTimeout,
+		resolver: surf.Resolver,
+		hosts:    hosts,
+		family:   key.family,
+		local:    local,
+	}
+	t := &http.Transport{
+		DialContext:           dialer.DialContext,
+		MaxIdleConns:          surf.MaxIdleConns,
+		MaxIdleConnsPerHost:   surf.MaxIdleConnsPerHost,
+		MaxConnsPerHost:       surf.MaxConnsPerHost,
+		IdleConnTimeout:       surf.IdleConnTimeout,
+		TLSHandshakeTimeout:   key.tlsTimeout,
+		ResponseHeaderTimeout: key.headerTimeout,
+	}
+	if t.MaxIdleConns == 0 {
+		t.MaxIdleConns = DefaultMaxIdleConns
+	}
+	if t.MaxIdleConnsPerHost == 0 {
+		t.MaxIdleConnsPerHost = DefaultMaxIdleConnsPerHost
+	}
+	if t.IdleConnTimeout == 0 {
+		t.IdleConnTimeout = DefaultIdleConnTimeout
+	}
+	if req.proxy != nil {
+		setProxy(t, req.proxy, dialer)
+	}
+	t.TLSClientConfig = config
+	switch key.httpVersion {
+	case HTTP1:
+		t.Protocols = new(http.Protocols)
+		t.Protocols.SetHTTP1(true)
+	case HTTP2:
+		t.Protocols = new(http.Protocols)
+		t.Protocols.SetHTTP2(true)
+		t.Protocols.SetUnencryptedHTTP2(true)
+	default:
+		// a custom DialContext and TLSClientConfig would otherwise disable HTTP/2
+		t.ForceAttemptHTTP2 = true
+	}
+	if key.https {
+		t.DisableCompression = true
+	}
+
+	if surf.transports == nil {
+		surf.transports = make(map[transportKey]*http.Transport)
+	}
+	// files rotated on disk replace the transport that loaded their former version
+	for k, old := range surf.transports {
+		if k.tlsFiles != key.tlsFiles && k.withoutFiles() == key.withoutFiles() {
+			delete(surf.transports, k)
+			old.CloseIdleConnections()
+		}
+	}
+	surf.transports[key] = t
+	return t, nil
+}
+
+// CloseIdleConnections closes the idle connections of every pooled transport.
+// It does not interrupt any connections currently in use.
+func (surf *Surf) CloseIdleConnections() {
+	surf.mu.Lock()
+	defer surf.mu.Unlock()
+	for _, t := range surf.transports {
+		t.CloseIdleConnections()
+	}
+}
+
+// Close closes all idle connections and drops the pooled transports.
+// The Surf stays usable; later downloads build new transports.
+func (surf *Surf) Close() error {
+	surf.mu.Lock()
+	defer surf.mu.Unlock()
+	for _, t := range surf.transports {
+		t.CloseIdleConnections()
+	}
+	surf.transports = nil
+	return nil
+}
@@ -15,6 +15,7 @@
 package surfer
 
 import (
+	"context"
 	"io"
 	"io/ioutil"
 	"log"
@@ -23,6 +24,7 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
 
 	"golang.org/x/net/html/charset"
 )
@@ -121,6 +123,21 @@ func WalkDir(targpath string, suffixes ...string) (dirlist []string) {
 	return
 }
 
+// sleepContext 停顿d时长，ctx结束时提前返回ctx.Err()
+func sleepContext(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return ctx.Err()
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
+
 // RespBody 封装Response.Body
 type RespBody struct {
 	io.ReadCloser